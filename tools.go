@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math/big"
 	"net/http"
 	"os"
@@ -24,6 +25,12 @@ type Tools struct {
 	UploadedFile       UploadedFile
 	MaxJSONSize        int
 	AllowUnknownFields bool
+	// ConfineDownloads makes DownloadStaticFile refuse, with a 404 response, any file name
+	// that leads outside its directory, through ".." or a symbolic link.
+	ConfineDownloads bool
+	// AllowDotFiles lets a confined DownloadStaticFile serve files and directories whose
+	// names start with a dot, such as .env.
+	AllowDotFiles bool
 }
 
 // RandomString generates a random string of length using characters from randomRunes
@@ -204,8 +211,18 @@ func (t *Tools) Slugify(s string) (string, error) {
 // It sets the appropriate headers to force the browser to download the file
 // instead of displaying it inline. This function allows specifying a custom
 // display name for the downloaded file.
+//
+// fileName must not come from the client unless Tools.ConfineDownloads is set.
 func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, dir, fileName, displayName string) {
 	fpath := path.Join(dir, fileName)
+	if t.ConfineDownloads {
+		var err error
+		fpath, err = t.confinedPath(dir, fileName)
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+	}
 
 	if _, err := os.Stat(fpath); os.IsNotExist(err) {
 		http.Error(w, "File not found", http.StatusNotFound)
@@ -217,6 +234,53 @@ func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, dir,
 	http.ServeFile(w, r, fpath)
 }
 
+// confinedPath joins dir and fileName, and makes sure the result is a file inside dir, even
+// once symbolic links are followed. Dotfiles are refused unless Tools.AllowDotFiles is set.
+func (t *Tools) confinedPath(dir, fileName string) (string, error) {
+	notFound := &fs.PathError{Op: "open", Path: fileName, Err: fs.ErrNotExist}
+
+	// backslashes are separators on Windows, so they are never let through as part of a name
+	name := strings.ReplaceAll(fileName, `\`, "/")
+	if strings.ContainsRune(name, 0) {
+		return "", notFound
+	}
+	if rel := path.Clean(name); rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", notFound
+	}
+	clean := path.Clean("/" + name)
+	if !t.AllowDotFiles && hasDotSegment(clean) {
+		return "", notFound
+	}
+
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", notFound
+	}
+	real, err := filepath.EvalSymlinks(filepath.Join(dir, filepath.FromSlash(clean)))
+	if err != nil {
+		return "", notFound
+	}
+	rel, err := filepath.Rel(root, real)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", notFound
+	}
+	// a link may lead to a dotfile under another name
+	if !t.AllowDotFiles && hasDotSegment(filepath.ToSlash(rel)) {
+		return "", notFound
+	}
+	return real, nil
+}
+
+// hasDotSegment reports whether any element of the slash separated path p starts with a dot.
+func hasDotSegment(p string) bool {
+	for _, elem := range strings.Split(p, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return true
+		}
+	}
+	return false
+}
+
 // JSONResponse is a struct used to pass JSON data around
 type JSONResponse struct {
 	Error   bool        `json:"error"`
@@ -12,6 +12,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -266,6 +268,68 @@ func TestTools_DownloadStaticFile(t *testing.T) {
 	}
 }
 
+var confinedDownloadTests = []struct {
+	name           string
+	fileName       string
+	allowDotFiles  bool
+	expectedStatus int
+}{
+	{name: "file", fileName: "report.txt", expectedStatus: http.StatusOK},
+	{name: "nested file", fileName: "sub/doc.txt", expectedStatus: http.StatusOK},
+	{name: "link inside root", fileName: "inner.txt", expectedStatus: http.StatusOK},
+	{name: "parent", fileName: "../secret.txt", expectedStatus: http.StatusNotFound},
+	{name: "deep traversal", fileName: "../../../../../../etc/passwd", expectedStatus: http.StatusNotFound},
+	{name: "absolute", fileName: "/etc/passwd", expectedStatus: http.StatusNotFound},
+	{name: "backslashes", fileName: `..\secret.txt`, expectedStatus: http.StatusNotFound},
+	{name: "traversal after directory", fileName: "sub/../../secret.txt", expectedStatus: http.StatusNotFound},
+	{name: "encoded dots", fileName: "%2e%2e/secret.txt", expectedStatus: http.StatusNotFound},
+	{name: "null byte", fileName: "report.txt\x00.png", expectedStatus: http.StatusNotFound},
+	{name: "link outside root", fileName: "link.txt", expectedStatus: http.StatusNotFound},
+	{name: "root itself", fileName: ".", expectedStatus: http.StatusNotFound},
+	{name: "dotfile", fileName: ".env", expectedStatus: http.StatusNotFound},
+	{name: "dot directory", fileName: ".git/config", expectedStatus: http.StatusNotFound},
+	{name: "link to dotfile", fileName: "hidden.txt", expectedStatus: http.StatusNotFound},
+	{name: "dotfile allowed", fileName: ".env", allowDotFiles: true, expectedStatus: http.StatusOK},
+}
+
+func TestTools_DownloadStaticFileConfined(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "public")
+	for name, content := range map[string]string{
+		"secret.txt":         "outside",
+		"public/report.txt":  "report",
+		"public/sub/doc.txt": "doc",
+		"public/.env":        "SECRET=1",
+		"public/.git/config": "[core]",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"link.txt": "../secret.txt", "inner.txt": "sub/doc.txt", "hidden.txt": ".env"} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skip("symbolic links not supported:", err)
+		}
+	}
+
+	for _, e := range confinedDownloadTests {
+		testTool := Tools{ConfineDownloads: true, AllowDotFiles: e.allowDotFiles}
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		testTool.DownloadStaticFile(rr, req, root, e.fileName, "download.txt")
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status code. wanted=%d, got=%d", e.name, e.expectedStatus, rr.Code)
+		}
+		if strings.Contains(rr.Body.String(), "outside") {
+			t.Errorf("%s: served a file outside the root", e.name)
+		}
+	}
+}
+
 var jsonTests = []struct {
 	name          string
 	json          string
@@ -0,0 +1,341 @@
+package toolbox
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ArchiveOptions limits what ExtractArchive is willing to extract. Zero values use the defaults.
+type ArchiveOptions struct {
+	// MaxSize is the largest total uncompressed size, in bytes, of all entries, and of the
+	// archive itself. It defaults to 1 GiB.
+	MaxSize int64
+	// MaxEntries is the largest number of entries, including directories and links. It
+	// defaults to 10,000.
+	MaxEntries int
+	// MaxRatio is the largest ratio between the uncompressed size of the entries and the size
+	// of the archive. It defaults to 100. It is only checked once more than 1 MiB has been
+	// extracted, since small files of repeated bytes compress far better than that.
+	MaxRatio float64
+}
+
+// minRatioCheck is how many bytes are extracted before ArchiveOptions.MaxRatio is checked.
+const minRatioCheck = 1 << 20
+
+func (o *ArchiveOptions) maxSize() int64 {
+	if o.MaxSize > 0 {
+		return o.MaxSize
+	}
+	return 1024 * 1024 * 1024
+}
+
+func (o *ArchiveOptions) maxEntries() int {
+	if o.MaxEntries > 0 {
+		return o.MaxEntries
+	}
+	return 10000
+}
+
+func (o *ArchiveOptions) maxRatio() float64 {
+	if o.MaxRatio > 0 {
+		return o.MaxRatio
+	}
+	return 100
+}
+
+// ArchiveEntryError is returned when an archive holds an entry that would be written outside
+// the target directory, or a link pointing outside it.
+type ArchiveEntryError struct {
+	Name   string
+	Reason string
+}
+
+func (e *ArchiveEntryError) Error() string {
+	return fmt.Sprintf("unsafe archive entry %q: %s", e.Name, e.Reason)
+}
+
+// ArchiveLimitError is returned when an archive goes over one of the ArchiveOptions limits.
+type ArchiveLimitError struct {
+	Reason string
+}
+
+func (e *ArchiveLimitError) Error() string {
+	return "archive rejected: " + e.Reason
+}
+
+// ExtractArchive extracts a zip, tar or gzip compressed tar archive into destDir through
+// Tools.Storage, keeping the directory structure of the archive. The format is detected from
+// the content. Each file is saved the way UploadFiles saves an uploaded file, so the
+// UploadedFile rules, such as AllowedFileTypes, MaxFileSize and the file name sanitizing, apply
+// to every entry, and the returned NewFileName is the path of the entry inside destDir.
+//
+// Entries that would land outside destDir, and links that point outside it, fail the
+// extraction with an *ArchiveEntryError; links are never created. Archives going over the
+// UploadedFile.Archive limits fail with an *ArchiveLimitError. With UploadedFile.Transactional
+// set, the entries extracted before a failure are removed again.
+func (t *Tools) ExtractArchive(ctx context.Context, archive io.Reader, destDir string) (extracted []*UploadedFile, err error) {
+	if t.UploadedFile.MaxFileSize == 0 {
+		t.UploadedFile.MaxFileSize = 1024 * 1024 * 1024
+	}
+
+	// zip needs random access, and the ratio check needs the size of the archive. An archive
+	// can not be larger than what it holds by much, so it is cut off at MaxSize too.
+	maxSize := t.UploadedFile.Archive.maxSize()
+	spool, size, err := spoolFile(io.LimitReader(archive, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	defer removeSpool(spool)
+	if size > maxSize {
+		return nil, &ArchiveLimitError{Reason: fmt.Sprintf("archive is over %d bytes", maxSize)}
+	}
+
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(spool, header)
+	header = header[:n]
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	x := &extraction{
+		t:         t,
+		ctx:       ctx,
+		destDir:   destDir,
+		state:     &uploadState{},
+		opts:      &t.UploadedFile.Archive,
+		available: int64(float64(max(size, 1)) * t.UploadedFile.Archive.maxRatio()),
+	}
+	defer func() {
+		if err != nil && t.UploadedFile.Transactional {
+			t.rollbackUpload(ctx, x.state)
+			extracted = nil
+		}
+	}()
+
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		err = x.zip(spool, size)
+	case bytes.HasPrefix(header, []byte{0x1F, 0x8B}):
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(spool)
+		if err != nil {
+			return nil, err
+		}
+		err = x.tar(gz)
+	case len(header) > 262 && string(header[257:262]) == "ustar":
+		err = x.tar(spool)
+	default:
+		return nil, errors.New("unsupported archive format, expected zip, tar or tar.gz")
+	}
+	return x.files, err
+}
+
+// extraction is the state of a single ExtractArchive call.
+type extraction struct {
+	t       *Tools
+	ctx     context.Context
+	destDir string
+	state   *uploadState
+	opts    *ArchiveOptions
+	entries int
+	// written is the uncompressed size extracted so far, and available the size the
+	// compression ratio allows for
+	written   int64
+	available int64
+	files     []*UploadedFile
+}
+
+func (x *extraction) zip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if err := x.ctx.Err(); err != nil {
+			return err
+		}
+		switch {
+		case f.Mode()&fs.ModeSymlink != 0:
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			target, err := io.ReadAll(io.LimitReader(rc, 4096))
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			if err := x.link(f.Name, string(target), false); err != nil {
+				return err
+			}
+		case f.FileInfo().IsDir():
+			if err := x.entry(f.Name); err != nil {
+				return err
+			}
+		case f.Mode().IsRegular():
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = x.file(f.Name, rc, int64(f.UncompressedSize64))
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			// devices, pipes and sockets are left out
+			if err := x.entry(f.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (x *extraction) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		if err := x.ctx.Err(); err != nil {
+			return err
+		}
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch h.Typeflag {
+		case tar.TypeSymlink:
+			err = x.link(h.Name, h.Linkname, false)
+		case tar.TypeLink:
+			err = x.link(h.Name, h.Linkname, true)
+		case tar.TypeReg:
+			err = x.file(h.Name, tr, h.Size)
+		default:
+			// directories are created along with the files in them, and devices, pipes
+			// and the extended headers are left out
+			err = x.entry(h.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// entryPath counts an entry against MaxEntries and returns its cleaned path inside the
+// archive, failing when it would land outside it.
+func (x *extraction) entryPath(name string) (string, error) {
+	x.entries++
+	if x.entries > x.opts.maxEntries() {
+		return "", &ArchiveLimitError{Reason: fmt.Sprintf("more than %d entries", x.opts.maxEntries())}
+	}
+
+	// some tools write Windows separators
+	clean := strings.ReplaceAll(name, `\`, "/")
+	if path.IsAbs(clean) || (len(clean) > 1 && clean[1] == ':') {
+		return "", &ArchiveEntryError{Name: name, Reason: "absolute path"}
+	}
+	clean = path.Clean(clean)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", &ArchiveEntryError{Name: name, Reason: "path escapes the target directory"}
+	}
+	return clean, nil
+}
+
+// entry checks an entry that is not extracted.
+func (x *extraction) entry(name string) error {
+	_, err := x.entryPath(name)
+	return err
+}
+
+// link checks a symbolic or hard link. Targets of symbolic links are relative to the
+// directory of the link, those of hard links to the root of the archive.
+func (x *extraction) link(name, target string, hard bool) error {
+	clean, err := x.entryPath(name)
+	if err != nil {
+		return err
+	}
+	target = strings.ReplaceAll(target, `\`, "/")
+	if path.IsAbs(target) {
+		return &ArchiveEntryError{Name: name, Reason: "link points outside the target directory"}
+	}
+	if !hard {
+		target = path.Join(path.Dir(clean), target)
+	}
+	if target = path.Clean(target); target == ".." || strings.HasPrefix(target, "../") {
+		return &ArchiveEntryError{Name: name, Reason: "link points outside the target directory"}
+	}
+	return nil
+}
+
+// file saves a regular file entry under destDir.
+func (x *extraction) file(name string, r io.Reader, size int64) error {
+	clean, err := x.entryPath(name)
+	if err != nil {
+		return err
+	}
+
+	// every directory in the path is sanitized like a file name
+	dir, base := path.Split(clean)
+	var parts []string
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		part, err := x.t.SanitizeFilename(part)
+		if err != nil {
+			return &ArchiveEntryError{Name: name, Reason: err.Error()}
+		}
+		parts = append(parts, part)
+	}
+	relDir := path.Join(parts...)
+
+	in := &archiveLimitReader{r: r, x: x}
+	uploadedFile, err := x.t.saveUploadedFile(x.ctx, x.state, in, "", base, size, path.Join(x.destDir, relDir), false)
+	if err != nil {
+		if in.err != nil {
+			return in.err
+		}
+		return fmt.Errorf("archive entry %q: %w", name, err)
+	}
+	uploadedFile.NewFileName = path.Join(relDir, uploadedFile.NewFileName)
+	x.files = append(x.files, uploadedFile)
+	return nil
+}
+
+// archiveLimitReader reads an entry, failing as soon as the archive goes over MaxSize
+// or MaxRatio.
+type archiveLimitReader struct {
+	r   io.Reader
+	x   *extraction
+	err error
+}
+
+func (l *archiveLimitReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	n, err := l.r.Read(p)
+	x := l.x
+	x.written += int64(n)
+	switch {
+	case x.written > x.opts.maxSize():
+		l.err = &ArchiveLimitError{Reason: fmt.Sprintf("uncompressed size is over %d bytes", x.opts.maxSize())}
+	case x.written > minRatioCheck && x.written > x.available:
+		l.err = &ArchiveLimitError{Reason: fmt.Sprintf("compression ratio is over %g", x.opts.maxRatio())}
+	}
+	if l.err != nil {
+		return n, l.err
+	}
+	return n, err
+}
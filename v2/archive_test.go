@@ -0,0 +1,194 @@
+package toolbox
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// testEntry is one entry of an archive built by testArchive. Entries with a link are
+// written as symbolic links, or hard links when hard is set.
+type testEntry struct {
+	name string
+	body string
+	link string
+	hard bool
+}
+
+// testArchive builds a zip, tar or tar.gz archive holding entries.
+func testArchive(t *testing.T, format string, entries ...testEntry) []byte {
+	var buf bytes.Buffer
+	if format == "zip" {
+		zw := zip.NewWriter(&buf)
+		for _, e := range entries {
+			h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+			body := e.body
+			if e.link != "" {
+				h.SetMode(fs.ModeSymlink | 0777)
+				body = e.link
+			}
+			w, err := zw.CreateHeader(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(body))
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	var gz *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if format == "tar.gz" {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	}
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		switch {
+		case e.link != "" && e.hard:
+			h.Typeflag, h.Linkname, h.Size = tar.TypeLink, e.link, 0
+		case e.link != "":
+			h.Typeflag, h.Linkname, h.Size = tar.TypeSymlink, e.link, 0
+		case strings.HasSuffix(e.name, "/"):
+			h.Typeflag, h.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			tw.Write([]byte(e.body))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+func TestTools_ExtractArchive(t *testing.T) {
+	entries := []testEntry{
+		{name: "docs/"},
+		{name: "docs/readme.txt", body: "read me"},
+		{name: "docs/latest.txt", link: "readme.txt"},
+		{name: "notes.txt", body: "some notes"},
+	}
+
+	for _, format := range []string{"zip", "tar", "tar.gz"} {
+		var store MemoryStorage
+		testTools := Tools{Storage: &store}
+
+		files, err := testTools.ExtractArchive(context.Background(), bytes.NewReader(testArchive(t, format, entries...)), "extracted")
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+
+		var names []string
+		for _, f := range files {
+			names = append(names, f.NewFileName)
+		}
+		if strings.Join(names, ",") != "docs/readme.txt,notes.txt" {
+			t.Errorf("%s: wrong files extracted: %v", format, names)
+		}
+		if _, err := store.Stat(context.Background(), "extracted/docs/readme.txt"); err != nil {
+			t.Errorf("%s: expected file in storage: %s", format, err)
+		}
+		if files[0].ContentType != "text/plain; charset=utf-8" {
+			t.Errorf("%s: wrong content type: %s", format, files[0].ContentType)
+		}
+	}
+}
+
+var extractArchiveTests = []struct {
+	name        string
+	format      string
+	entries     []testEntry
+	opts        ArchiveOptions
+	allowed     []string
+	unsafe      bool
+	overLimit   bool
+	errExpected bool
+}{
+	{name: "zip slip", format: "zip", entries: []testEntry{{name: "../evil.txt", body: "x"}}, unsafe: true},
+	{name: "zip slip with backslashes", format: "zip", entries: []testEntry{{name: `..\..\evil.txt`, body: "x"}}, unsafe: true},
+	{name: "nested zip slip", format: "tar", entries: []testEntry{{name: "a/../../evil.txt", body: "x"}}, unsafe: true},
+	{name: "absolute path", format: "tar", entries: []testEntry{{name: "/etc/cron.d/evil", body: "x"}}, unsafe: true},
+	{name: "symlink outside", format: "tar.gz", entries: []testEntry{{name: "a/link", link: "../../etc/passwd"}}, unsafe: true},
+	{name: "absolute symlink", format: "zip", entries: []testEntry{{name: "link", link: "/etc/passwd"}}, unsafe: true},
+	{name: "hard link outside", format: "tar", entries: []testEntry{{name: "a/link", link: "../secret", hard: true}}, unsafe: true},
+	{name: "too many entries", format: "zip", entries: []testEntry{{name: "a.txt", body: "a"}, {name: "b.txt", body: "b"}, {name: "c.txt", body: "c"}}, opts: ArchiveOptions{MaxEntries: 2}, overLimit: true},
+	{name: "too large", format: "tar.gz", entries: []testEntry{{name: "a.txt", body: strings.Repeat("a", 2000)}}, opts: ArchiveOptions{MaxSize: 1000}, overLimit: true},
+	{name: "compression ratio", format: "tar.gz", entries: []testEntry{{name: "zeros.txt", body: strings.Repeat("0", 4<<20)}}, overLimit: true},
+	{name: "file type not allowed", format: "zip", entries: []testEntry{{name: "a.txt", body: "text"}}, allowed: []string{"image/png"}, errExpected: true},
+}
+
+func TestTools_ExtractArchiveRejected(t *testing.T) {
+	for _, e := range extractArchiveTests {
+		var store MemoryStorage
+		testTools := Tools{Storage: &store}
+		testTools.UploadedFile.Archive = e.opts
+		testTools.UploadedFile.AllowedFileTypes = e.allowed
+
+		_, err := testTools.ExtractArchive(context.Background(), bytes.NewReader(testArchive(t, e.format, e.entries...)), "extracted")
+		if err == nil {
+			t.Errorf("%s: expected an error", e.name)
+			continue
+		}
+
+		var unsafe *ArchiveEntryError
+		var overLimit *ArchiveLimitError
+		if e.unsafe && !errors.As(err, &unsafe) {
+			t.Errorf("%s: expected *ArchiveEntryError, got %v", e.name, err)
+		}
+		if e.overLimit && !errors.As(err, &overLimit) {
+			t.Errorf("%s: expected *ArchiveLimitError, got %v", e.name, err)
+		}
+		if e.errExpected && !errors.Is(err, errFileTypeNotPermitted) {
+			t.Errorf("%s: expected file type error, got %v", e.name, err)
+		}
+	}
+}
+
+func TestTools_ExtractArchiveTooLarge(t *testing.T) {
+	testTools := Tools{Storage: &MemoryStorage{}}
+	testTools.UploadedFile.Archive.MaxSize = 1000
+
+	// an endless upload is cut off instead of filling the temporary directory
+	zeros := &zeroReader{}
+	_, err := testTools.ExtractArchive(context.Background(), zeros, "extracted")
+	var overLimit *ArchiveLimitError
+	if !errors.As(err, &overLimit) {
+		t.Fatalf("expected *ArchiveLimitError, got %v", err)
+	}
+	if zeros.n > 1<<20 {
+		t.Errorf("wrong number of bytes read. wanted at most %d, got=%d", 1<<20, zeros.n)
+	}
+}
+
+func TestTools_ExtractArchiveTransactional(t *testing.T) {
+	var store MemoryStorage
+	testTools := Tools{Storage: &store}
+	testTools.UploadedFile.Transactional = true
+
+	archive := testArchive(t, "tar", testEntry{name: "a.txt", body: "a"}, testEntry{name: "../b.txt", body: "b"})
+	files, err := testTools.ExtractArchive(context.Background(), bytes.NewReader(archive), "extracted")
+	if err == nil || files != nil {
+		t.Fatalf("expected an error and no files, got %v, %v", files, err)
+	}
+
+	list, _ := store.List(context.Background(), "extracted/")
+	if len(list) != 0 {
+		t.Errorf("files left after rollback: %v", list)
+	}
+}
@@ -0,0 +1,294 @@
+package toolbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CatalogEntry records an upload saved while Tools.Catalog is set.
+type CatalogEntry struct {
+	ID string `json:"id"`
+	// Key is the storage key of the saved file.
+	Key          string `json:"key"`
+	OrigFileName string `json:"orig_file_name"`
+	ContentType  string `json:"content_type"`
+	FileSize     int64  `json:"file_size"`
+	Checksum     string `json:"checksum,omitempty"`
+	FieldName    string `json:"field_name,omitempty"`
+	// Uploader is the value returned by Tools.Uploader for the upload request.
+	Uploader string `json:"uploader,omitempty"`
+	// Derived holds the storage keys of the files created from the upload, such as thumbnails.
+	Derived   []string  `json:"derived,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Catalog keeps a record of every upload, so the original name, type and uploader of a file
+// can be looked up by its ID after it has been saved under a random name. Get returns an error
+// wrapping fs.ErrNotExist for an unknown ID. List returns the entries ordered by creation time.
+type Catalog interface {
+	Add(ctx context.Context, entry CatalogEntry) error
+	Get(ctx context.Context, id string) (*CatalogEntry, error)
+	List(ctx context.Context) ([]CatalogEntry, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// randomID returns 32 random hex characters, safe to use in URLs and file names.
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// catalogUpload records a saved file in Tools.Catalog, and sets its ID.
+func (t *Tools) catalogUpload(ctx context.Context, state *uploadState, uploadedFile *UploadedFile, uploadDir string) error {
+	id, err := randomID()
+	if err != nil {
+		return err
+	}
+	entry := CatalogEntry{
+		ID:           id,
+		Key:          storageKey(uploadDir, uploadedFile.NewFileName),
+		OrigFileName: uploadedFile.OrigFileName,
+		ContentType:  uploadedFile.ContentType,
+		FileSize:     uploadedFile.FileSize,
+		Checksum:     uploadedFile.Checksum,
+		FieldName:    uploadedFile.FieldName,
+		Uploader:     state.uploader,
+		CreatedAt:    time.Now().UTC(),
+	}
+	for _, d := range uploadedFile.Derived {
+		entry.Derived = append(entry.Derived, storageKey(uploadDir, d.NewFileName))
+	}
+	if err := t.Catalog.Add(ctx, entry); err != nil {
+		// a file that can not be found by its ID is of no use, so it is removed again
+		if !uploadedFile.Duplicate {
+			for _, key := range append([]string{entry.Key}, entry.Derived...) {
+				_ = t.storage().Delete(context.WithoutCancel(ctx), key)
+			}
+		}
+		return fmt.Errorf("unable to record upload in catalog: %w", err)
+	}
+	uploadedFile.ID = id
+	state.mu.Lock()
+	state.cataloged = append(state.cataloged, id)
+	state.mu.Unlock()
+	return nil
+}
+
+// DownloadByID serves the upload recorded in Tools.Catalog under id, with its original file
+// name as the download name. Unknown IDs get a 404 response.
+func (t *Tools) DownloadByID(w http.ResponseWriter, r *http.Request, id string, opts ...DownloadOptions) {
+	if t.Catalog == nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	entry, err := t.Catalog.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	t.serveKey(w, r, entry.Key, entry.OrigFileName, opts...)
+}
+
+// DeleteUpload removes the upload recorded in Tools.Catalog under id: the file, the files
+// derived from it and the catalog entry. A content addressed file still recorded under
+// another ID is kept.
+func (t *Tools) DeleteUpload(ctx context.Context, id string) error {
+	if t.Catalog == nil {
+		return errors.New("no catalog configured")
+	}
+	entry, err := t.Catalog.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	shared := false
+	if t.UploadedFile.ContentAddressed {
+		entries, err := t.Catalog.List(ctx)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.ID != id && e.Key == entry.Key {
+				shared = true
+				break
+			}
+		}
+	}
+	return t.deleteUpload(ctx, entry, shared)
+}
+
+// deleteUpload removes the catalog entry of an upload along with its files, unless shared
+// tells that they are still recorded under another ID.
+func (t *Tools) deleteUpload(ctx context.Context, entry *CatalogEntry, shared bool) error {
+	if !shared {
+		for _, key := range append([]string{entry.Key}, entry.Derived...) {
+			if err := t.storage().Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	if err := t.Catalog.Delete(ctx, entry.ID); err != nil {
+		return err
+	}
+	if t.Quota.MaxBytes > 0 || t.Quota.MaxFiles > 0 {
+		return t.Quota.usage().Release(ctx, entry.Uploader, Usage{Bytes: entry.FileSize, Files: 1})
+	}
+	return nil
+}
+
+// MemoryCatalog is a Catalog kept in memory. The zero value is ready to use.
+type MemoryCatalog struct {
+	mu      sync.RWMutex
+	entries map[string]CatalogEntry
+}
+
+func (c *MemoryCatalog) Add(ctx context.Context, entry CatalogEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]CatalogEntry)
+	}
+	c.entries[entry.ID] = entry
+	return nil
+}
+
+func (c *MemoryCatalog) Get(ctx context.Context, id string) (*CatalogEntry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[id]
+	if !ok {
+		return nil, &fs.PathError{Op: "get", Path: id, Err: fs.ErrNotExist}
+	}
+	return &entry, nil
+}
+
+func (c *MemoryCatalog) List(ctx context.Context) ([]CatalogEntry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entries := make([]CatalogEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	sortCatalogEntries(entries)
+	return entries, nil
+}
+
+func (c *MemoryCatalog) Delete(ctx context.Context, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[id]; !ok {
+		return &fs.PathError{Op: "delete", Path: id, Err: fs.ErrNotExist}
+	}
+	delete(c.entries, id)
+	return nil
+}
+
+// JSONCatalog is a Catalog keeping every entry as a JSON sidecar file, named after its ID,
+// in Dir on the local disk.
+type JSONCatalog struct {
+	Dir string
+}
+
+func (c JSONCatalog) path(id string) (string, error) {
+	// IDs come from URLs, so only the ones randomID hands out are accepted
+	if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+		return "", &fs.PathError{Op: "open", Path: id, Err: fs.ErrNotExist}
+	}
+	return filepath.Join(c.Dir, id+".json"), nil
+}
+
+func (c JSONCatalog) Add(ctx context.Context, entry CatalogEntry) error {
+	p, err := c.path(entry.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(entry, "", "\t")
+	if err != nil {
+		return err
+	}
+	// written to a temporary file and renamed, so an entry is never read half written
+	_, err = DiskStorage{}.Put(ctx, p, bytes.NewReader(data))
+	return err
+}
+
+func (c JSONCatalog) Get(ctx context.Context, id string) (*CatalogEntry, error) {
+	p, err := c.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var entry CatalogEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("catalog entry %s: %w", id, err)
+	}
+	return &entry, nil
+}
+
+func (c JSONCatalog) List(ctx context.Context) ([]CatalogEntry, error) {
+	files, err := os.ReadDir(c.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []CatalogEntry
+	for _, f := range files {
+		id, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok || f.IsDir() {
+			continue
+		}
+		entry, err := c.Get(ctx, id)
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed since the directory was read, or not a catalog entry
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	sortCatalogEntries(entries)
+	return entries, nil
+}
+
+func (c JSONCatalog) Delete(ctx context.Context, id string) error {
+	p, err := c.path(id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func sortCatalogEntries(entries []CatalogEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].CreatedAt.Equal(entries[j].CreatedAt) {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+}
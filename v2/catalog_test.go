@@ -0,0 +1,122 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCatalog runs the same add, get, list and delete checks against any Catalog.
+func testCatalog(t *testing.T, name string, catalog Catalog) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	var ids []string
+	for i, orig := range []string{"first.png", "second.pdf", "third.txt"} {
+		id, err := randomID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		entry := CatalogEntry{ID: id, Key: "uploads/" + id, OrigFileName: orig, CreatedAt: now.Add(time.Duration(i) * time.Minute)}
+		if err := catalog.Add(ctx, entry); err != nil {
+			t.Fatalf("%s: add: %s", name, err)
+		}
+	}
+
+	entry, err := catalog.Get(ctx, ids[1])
+	if err != nil {
+		t.Fatalf("%s: get: %s", name, err)
+	}
+	if entry.OrigFileName != "second.pdf" || !entry.CreatedAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("%s: wrong entry: %+v", name, entry)
+	}
+
+	list, err := catalog.List(ctx)
+	if err != nil {
+		t.Fatalf("%s: list: %s", name, err)
+	}
+	var names []string
+	for _, e := range list {
+		names = append(names, e.OrigFileName)
+	}
+	if strings.Join(names, ",") != "first.png,second.pdf,third.txt" {
+		t.Errorf("%s: wrong listing: %v", name, names)
+	}
+
+	if err := catalog.Delete(ctx, ids[0]); err != nil {
+		t.Errorf("%s: delete: %s", name, err)
+	}
+	if _, err := catalog.Get(ctx, ids[0]); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s: expected deleted entry to not exist, got %v", name, err)
+	}
+	if _, err := catalog.Get(ctx, "../../etc/passwd"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s: expected fs.ErrNotExist for invalid ID, got %v", name, err)
+	}
+}
+
+func TestMemoryCatalog(t *testing.T) {
+	testCatalog(t, "memory", &MemoryCatalog{})
+}
+
+func TestJSONCatalog(t *testing.T) {
+	testCatalog(t, "json", JSONCatalog{Dir: t.TempDir()})
+}
+
+func TestTools_UploadFilesCatalog(t *testing.T) {
+	var store MemoryStorage
+	var catalog MemoryCatalog
+	testTools := Tools{
+		Storage:  &store,
+		Catalog:  &catalog,
+		Uploader: func(r *http.Request) string { return r.Header.Get("X-User") },
+	}
+	testTools.UploadedFile.Image.Thumbnails = []ThumbnailSize{{Name: "small", Width: 16}}
+
+	req := newMultipartRequest(t, testPart{field: "avatar", fileName: "me.png", data: testPNG(t)})
+	req.Header.Set("X-User", "user-42")
+	files, err := testTools.UploadFiles(req, "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files[0].ID == "" {
+		t.Fatal("expected the file to get an ID")
+	}
+
+	entry, err := catalog.Get(context.Background(), files[0].ID)
+	if err != nil {
+		t.Fatalf("expected catalog entry: %s", err)
+	}
+	if entry.Key != "uploads/"+files[0].NewFileName || entry.OrigFileName != "me.png" || entry.Uploader != "user-42" ||
+		entry.FieldName != "avatar" || entry.ContentType != "image/png" || len(entry.Derived) != 1 {
+		t.Errorf("wrong catalog entry: %+v", entry)
+	}
+
+	rr := httptest.NewRecorder()
+	testTools.DownloadByID(rr, httptest.NewRequest("GET", "/", nil), files[0].ID)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code. wanted=200, got=%d", rr.Code)
+	}
+	if rr.Header().Get("Content-Disposition") != "attachment; filename=\"me.png\"" {
+		t.Errorf("wrong content disposition: %s", rr.Header().Get("Content-Disposition"))
+	}
+
+	if err := testTools.DeleteUpload(context.Background(), files[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := store.List(context.Background(), "uploads/")
+	if len(list) != 0 {
+		t.Errorf("files left after delete: %v", list)
+	}
+
+	rr = httptest.NewRecorder()
+	testTools.DownloadByID(rr, httptest.NewRequest("GET", "/", nil), files[0].ID)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status code for deleted upload. wanted=404, got=%d", rr.Code)
+	}
+}
@@ -0,0 +1,92 @@
+package toolbox
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The dispositions ContentDisposition accepts.
+const (
+	DispositionAttachment = "attachment"
+	DispositionInline     = "inline"
+)
+
+// asciiBase returns the ASCII letter r is made of, such as e for é, for the ASCII fallback of
+// a Content-Disposition file name. It reports false when r is not an ASCII letter with marks.
+func asciiBase(r rune) (rune, bool) {
+	decomposed := []rune(norm.NFD.String(string(r)))
+	if len(decomposed) < 2 || decomposed[0] >= unicode.MaxASCII || !unicode.IsLetter(decomposed[0]) {
+		return 0, false
+	}
+	for _, mark := range decomposed[1:] {
+		if !unicode.Is(unicode.Mn, mark) {
+			return 0, false
+		}
+	}
+	return decomposed[0], true
+}
+
+// ContentDisposition builds a Content-Disposition header value, as described in RFC 6266, for
+// a file sent inline or as an attachment; any disposition other than DispositionInline is
+// taken as an attachment. Quotes and backslashes in fileName are escaped and control characters
+// dropped, so the name can not break out of the header. A name that is not plain ASCII gets an
+// ASCII fallback in filename, with accents removed and other characters replaced by an
+// underscore, followed by the full name encoded as UTF-8 in filename*, as in RFC 5987.
+func (t *Tools) ContentDisposition(disposition, fileName string) string {
+	return contentDisposition(disposition, fileName)
+}
+
+func contentDisposition(disposition, fileName string) string {
+	if disposition != DispositionInline {
+		disposition = DispositionAttachment
+	}
+
+	var clean, fallback strings.Builder
+	ascii := true
+	for _, r := range norm.NFC.String(fileName) {
+		switch {
+		case unicode.IsControl(r) || unicode.Is(unicode.Cf, r):
+			// newlines could end the header, and format characters such as
+			// right-to-left overrides disguise the name
+			continue
+		case r == '"' || r == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(r)
+		case r < unicode.MaxASCII:
+			fallback.WriteRune(r)
+		default:
+			ascii = false
+			if base, ok := asciiBase(r); ok {
+				fallback.WriteRune(base)
+			} else {
+				fallback.WriteByte('_')
+			}
+		}
+		clean.WriteRune(r)
+	}
+
+	value := disposition + `; filename="` + fallback.String() + `"`
+	if !ascii {
+		value += "; filename*=UTF-8''" + encodeRFC5987(clean.String())
+	}
+	return value
+}
+
+// encodeRFC5987 percent-encodes every byte of s that is not an attr-char of RFC 5987.
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0f])
+	}
+	return b.String()
+}
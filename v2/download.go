@@ -0,0 +1,177 @@
+package toolbox
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SandboxCSP is a Content-Security-Policy for serving files uploaded by users: the file may
+// not run scripts, load anything or submit forms, so an HTML or SVG upload displayed inline
+// can not act on behalf of the site.
+const SandboxCSP = "default-src 'none'; style-src 'unsafe-inline'; sandbox"
+
+// DownloadOptions changes how DownloadStaticFile, DownloadFromFS and DownloadByID send a file.
+// The zero value sends it as an application/octet-stream attachment.
+type DownloadOptions struct {
+	// DetectContentType sets Content-Type from the extension of the file, or of its display
+	// name, and otherwise from its leading bytes, as detected by Tools.FileTypes.
+	DetectContentType bool
+	// Inline lets the browser display the file, such as a PDF or an image, instead of
+	// saving it.
+	Inline bool
+	// ContentSecurityPolicy, when set, is sent as the Content-Security-Policy header, such
+	// as SandboxCSP for files uploaded by users.
+	ContentSecurityPolicy string
+}
+
+// downloadContentType returns the MIME type of content, stored under name. When the type
+// has to be sniffed, the returned reader replaces content, starting again from the beginning.
+func (t *Tools) downloadContentType(content io.Reader, name, displayName string) (string, io.Reader, error) {
+	for _, n := range []string{name, displayName} {
+		if contentType := mime.TypeByExtension(path.Ext(n)); contentType != "" {
+			return contentType, content, nil
+		}
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", nil, err
+	}
+	head = head[:n]
+	contentType := t.fileTypes().Detect(head)
+
+	if seeker, ok := content.(io.Seeker); ok {
+		_, err := seeker.Seek(0, io.SeekStart)
+		return contentType, content, err
+	}
+	return contentType, io.MultiReader(bytes.NewReader(head), content), nil
+}
+
+// ZipEntry is a file to add to the archive sent by DownloadZip.
+type ZipEntry struct {
+	// Path is the file to add, as passed to DownloadStaticFile.
+	Path string
+	// Name is the name of the file in the archive, which may include folders, such as
+	// "invoices/march.pdf". The base name of Path is used when it is empty.
+	Name string
+}
+
+// DownloadZip sends the files in entries as a zip archive named displayName, compressed as it
+// is written to w without any temporary file. Paths are confined to Tools.DownloadRoot, when
+// set, just as in DownloadStaticFile, and every file is looked up before anything is sent, so
+// a missing one gets a 404 response. Names in the archive are sanitized, keeping any folders,
+// and duplicates are numbered, such as "report (2).pdf".
+//
+// Once the archive has started, a failure can only cut it short. The error is returned, so it
+// can be logged; it is the error of the request context when the client went away.
+func (t *Tools) DownloadZip(w http.ResponseWriter, r *http.Request, entries []ZipEntry, displayName string) error {
+	ctx := r.Context()
+	store := t.storage()
+
+	type zipFile struct {
+		key  string
+		name string
+		info *FileInfo
+	}
+	files := make([]zipFile, 0, len(entries))
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		key := filepath.ToSlash(entry.Path)
+		if t.DownloadRoot != "" {
+			var err error
+			key, err = t.confinedDownloadKey(entry.Path)
+			if err != nil {
+				http.Error(w, "File not found", http.StatusNotFound)
+				return err
+			}
+		}
+		info, err := store.Stat(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return err
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return err
+		}
+
+		name := entry.Name
+		if name == "" {
+			name = path.Base(key)
+		}
+		files = append(files, zipFile{key: key, name: t.zipEntryName(name, names), info: info})
+	}
+
+	w.Header().Set("Content-Disposition", contentDisposition(DispositionAttachment, displayName))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := t.writeZipEntry(ctx, zw, f.key, f.name, f.info); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeZipEntry copies the file stored under key into zw as name.
+func (t *Tools) writeZipEntry(ctx context.Context, zw *zip.Writer, key, name string, info *FileInfo) error {
+	file, err := t.storage().Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	t.touch(ctx, key)
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: info.ModTime})
+	if err != nil {
+		return err
+	}
+	// reading stops as soon as the client goes away, rather than when a write fails
+	_, err = io.Copy(fw, &contextBody{ctx: ctx, ReadCloser: file})
+	return err
+}
+
+// zipEntryName sanitizes every element of name and numbers it when it is already in use,
+// which it then records.
+func (t *Tools) zipEntryName(name string, used map[string]bool) string {
+	var elems []string
+	for _, elem := range strings.Split(strings.ReplaceAll(name, `\`, "/"), "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			continue
+		}
+		if clean, err := t.SanitizeFilename(elem); err == nil {
+			elems = append(elems, clean)
+		}
+	}
+	if len(elems) == 0 {
+		elems = []string{"file"}
+	}
+	name = strings.Join(elems, "/")
+
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 2; used[strings.ToLower(name)]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}
@@ -0,0 +1,54 @@
+package toolbox
+
+import "fmt"
+
+// FileTooLargeError is returned when an uploaded file is bigger than UploadedFile.MaxFileSize.
+// Size is the size of the file when it is known up front. When the file is streamed, the
+// upload stops as soon as the limit is passed, so Size is only the number of bytes read by then.
+type FileTooLargeError struct {
+	FileName string
+	Limit    int64
+	Size     int64
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("uploaded file %q is too big: got %d bytes, limit is %d", e.FileName, e.Size, e.Limit)
+}
+
+// RequestTooLargeError is returned when the files in one request add up to more than
+// UploadedFile.MaxTotalSize. As with FileTooLargeError, Size may only be the number of bytes
+// read before the upload was stopped.
+//
+// A parsed form is also refused as a whole when its body goes well over what its files may
+// add up to, before any file is looked at. Without MaxTotalSize, Limit is then MaxFileSize
+// times MaxFiles, and Size is the length of the body. With neither set, the body is not
+// capped and each file is checked against MaxFileSize instead. A body cut off before it
+// reached Tools, such as by the MaxSize of a signed URL, is reported with that limit.
+type RequestTooLargeError struct {
+	Limit int64
+	Size  int64
+}
+
+func (e *RequestTooLargeError) Error() string {
+	return fmt.Sprintf("upload request is too big: got %d bytes, limit is %d", e.Size, e.Limit)
+}
+
+// TooManyFilesError is returned when a request holds more files than UploadedFile.MaxFiles.
+type TooManyFilesError struct {
+	Limit int
+	Count int
+}
+
+func (e *TooManyFilesError) Error() string {
+	return fmt.Sprintf("too many files uploaded: got %d, limit is %d", e.Count, e.Limit)
+}
+
+// UnexpectedFieldError is returned when a file is sent in a form field that is not one of
+// UploadedFile.AllowedFields.
+type UnexpectedFieldError struct {
+	FieldName string
+}
+
+func (e *UnexpectedFieldError) Error() string {
+	return fmt.Sprintf("files are not accepted in form field %q", e.FieldName)
+}
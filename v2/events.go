@@ -0,0 +1,71 @@
+package toolbox
+
+import "errors"
+
+// UploadEventType tells what happened to a file in an UploadEvent.
+type UploadEventType int
+
+const (
+	// UploadStarted is sent before the first byte of a file is read.
+	UploadStarted UploadEventType = iota
+	// UploadProgress is sent every time a chunk of the file has been read and passed on
+	// to the storage.
+	UploadProgress
+	// UploadFinished is sent once the file has been saved.
+	UploadFinished
+	// UploadRejected is sent when the file is refused or could not be saved. UploadEvent.Err
+	// holds the reason.
+	UploadRejected
+)
+
+func (e UploadEventType) String() string {
+	switch e {
+	case UploadStarted:
+		return "started"
+	case UploadProgress:
+		return "progress"
+	case UploadFinished:
+		return "finished"
+	case UploadRejected:
+		return "rejected"
+	}
+	return "unknown"
+}
+
+// UploadEvent describes the progress of a single uploaded file.
+type UploadEvent struct {
+	Type UploadEventType
+	// FieldName is the form field the file was sent in, when it came from a form.
+	FieldName string
+	// FileName is the file name sent by the client. It is empty when a whole request is
+	// rejected before any file was looked at, such as when it has too many files.
+	FileName string
+	// Size is the size of the file announced by the client, or -1 when it is not known
+	// until the file has been read, as with UploadedFile.Stream.
+	Size int64
+	// Written is the number of bytes read so far.
+	Written int64
+	// File is the saved file, set on UploadFinished.
+	File *UploadedFile
+	// Err is the reason the file was rejected, set on UploadRejected.
+	Err error
+}
+
+// emit passes e to Tools.OnUploadEvent, if it is set.
+func (t *Tools) emit(e UploadEvent) {
+	if t.OnUploadEvent != nil {
+		t.OnUploadEvent(e)
+	}
+}
+
+// rejectRequest reports an upload refused as a whole and returns err.
+func (t *Tools) rejectRequest(err error) error {
+	e := UploadEvent{Type: UploadRejected, Size: -1, Err: err}
+	var tooLarge *FileTooLargeError
+	if errors.As(err, &tooLarge) {
+		e.FileName = tooLarge.FileName
+		e.Size = tooLarge.Size
+	}
+	t.emit(e)
+	return err
+}
@@ -0,0 +1,76 @@
+package toolbox
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTools_UploadEvents(t *testing.T) {
+	pngData := testPNG(t)
+
+	for _, stream := range []bool{false, true} {
+		var events []UploadEvent
+		testTools := Tools{Storage: &MemoryStorage{}}
+		testTools.UploadedFile.AllowedFileTypes = []string{"image/png"}
+		testTools.UploadedFile.Stream = stream
+		testTools.OnUploadEvent = func(e UploadEvent) { events = append(events, e) }
+
+		req := newMultipartRequest(t,
+			testPart{field: "a", fileName: "a.png", data: pngData},
+			testPart{field: "b", fileName: "b.txt", data: []byte("not an image")},
+		)
+		_, err := testTools.UploadFiles(req, "uploads")
+		if !errors.Is(err, errFileTypeNotPermitted) {
+			t.Fatalf("stream=%t: expected file type error, got %v", stream, err)
+		}
+
+		// collapse the progress events, their number depends on the chunk sizes
+		var types []string
+		for _, e := range events {
+			if e.Type == UploadProgress && types[len(types)-1] == "progress" {
+				continue
+			}
+			types = append(types, e.Type.String())
+		}
+		if got := strings.Join(types, ","); got != "started,progress,finished,started,rejected" {
+			t.Errorf("stream=%t: wrong events: %s", stream, got)
+		}
+
+		finished := events[len(events)-3]
+		if finished.File == nil || finished.Written != int64(len(pngData)) {
+			t.Errorf("stream=%t: wrong finished event: %+v", stream, finished)
+		}
+		if !stream && finished.Size != int64(len(pngData)) {
+			t.Errorf("wrong size. wanted=%d, got=%d", len(pngData), finished.Size)
+		}
+		if stream && finished.Size != -1 {
+			t.Errorf("stream: wrong size. wanted=-1, got=%d", finished.Size)
+		}
+
+		rejected := events[len(events)-1]
+		if rejected.FileName != "b.txt" || rejected.Err == nil {
+			t.Errorf("stream=%t: wrong rejected event: %+v", stream, rejected)
+		}
+	}
+}
+
+func TestTools_UploadEventsRequestRejected(t *testing.T) {
+	var events []UploadEvent
+	testTools := Tools{Storage: &MemoryStorage{}}
+	testTools.UploadedFile.MaxFileSize = 10
+	testTools.OnUploadEvent = func(e UploadEvent) { events = append(events, e) }
+
+	req := newMultipartRequest(t, testPart{field: "a", fileName: "a.png", data: testPNG(t)})
+	if _, err := testTools.UploadFiles(req, "uploads"); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("wrong number of events. wanted=1, got=%d", len(events))
+	}
+	var tooLarge *FileTooLargeError
+	if events[0].Type != UploadRejected || events[0].FileName != "a.png" || !errors.As(events[0].Err, &tooLarge) {
+		t.Errorf("wrong rejected event: %+v", events[0])
+	}
+}
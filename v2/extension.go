@@ -0,0 +1,116 @@
+package toolbox
+
+import (
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// ExtensionPolicy controls how UploadFiles treats a file whose extension does not match
+// the type detected from its content.
+type ExtensionPolicy int
+
+const (
+	// ExtensionIgnore keeps the extension of the uploaded file name as it is. This is the default.
+	ExtensionIgnore ExtensionPolicy = iota
+	// ExtensionReject rejects files whose extension is not one used for the detected type,
+	// with an *ExtensionMismatchError.
+	ExtensionReject
+	// ExtensionRewrite saves files with the canonical extension of the detected type,
+	// whatever extension they were uploaded with.
+	ExtensionRewrite
+)
+
+// ExtensionRule names the check that failed in an *ExtensionMismatchError.
+type ExtensionRule string
+
+const (
+	// ExtensionRuleMissing means the file name has no extension.
+	ExtensionRuleMissing ExtensionRule = "missing extension"
+	// ExtensionRuleUnknownType means no extensions are known for the detected type, so
+	// none could be checked or chosen.
+	ExtensionRuleUnknownType ExtensionRule = "no known extension for content type"
+	// ExtensionRuleMismatch means the extension is not one used for the detected type.
+	ExtensionRuleMismatch ExtensionRule = "extension does not match content type"
+)
+
+// ExtensionMismatchError is returned when an uploaded file fails the check set by
+// UploadedFile.ExtensionPolicy.
+type ExtensionMismatchError struct {
+	FileName    string
+	Extension   string
+	ContentType string
+	Rule        ExtensionRule
+}
+
+func (e *ExtensionMismatchError) Error() string {
+	return fmt.Sprintf("uploaded file %q: %s (extension %q, content type %s)", e.FileName, e.Rule, e.Extension, e.ContentType)
+}
+
+// fallbackExtensions lists the extensions for types reported by http.DetectContentType
+// that have no signature in the registry.
+var fallbackExtensions = map[string][]string{
+	"text/plain":               {".txt", ".text", ".csv", ".tsv", ".log", ".md", ".json", ".yaml", ".yml", ".ini", ".conf"},
+	"text/html":                {".html", ".htm"},
+	"text/xml":                 {".xml"},
+	"application/octet-stream": {".bin"},
+	"application/postscript":   {".ps", ".eps"},
+	"application/ogg":          {".ogg", ".ogx"},
+	"audio/basic":              {".snd", ".au"},
+	"font/collection":          {".ttc"},
+}
+
+// Extensions returns the file name extensions used for mimeType, canonical one first. Any
+// parameters on mimeType are ignored. Registered types are looked up first, then the types
+// known to net/http and finally the system MIME table.
+func (r *FileTypes) Extensions(mimeType string) []string {
+	mimeType = baseMediaType(mimeType)
+
+	r.mu.RLock()
+	for i := len(r.types) - 1; i >= 0; i-- {
+		if strings.EqualFold(r.types[i].MIMEType, mimeType) && len(r.types[i].Extensions) > 0 {
+			r.mu.RUnlock()
+			return r.types[i].Extensions
+		}
+	}
+	r.mu.RUnlock()
+
+	if exts, ok := fallbackExtensions[mimeType]; ok {
+		return exts
+	}
+	exts, _ := mime.ExtensionsByType(mimeType)
+	return exts
+}
+
+// uploadExtension returns the extension an uploaded file is saved with, applying
+// UploadedFile.ExtensionPolicy to the name it was uploaded with and its detected type.
+func (t *Tools) uploadExtension(fileName, contentType string) (string, error) {
+	ext := filepath.Ext(fileName)
+	policy := t.UploadedFile.ExtensionPolicy
+	if policy == ExtensionIgnore {
+		return ext, nil
+	}
+
+	mismatch := func(rule ExtensionRule) error {
+		return &ExtensionMismatchError{FileName: fileName, Extension: ext, ContentType: contentType, Rule: rule}
+	}
+
+	known := t.fileTypes().Extensions(contentType)
+	if len(known) == 0 {
+		return "", mismatch(ExtensionRuleUnknownType)
+	}
+	if policy == ExtensionRewrite {
+		return known[0], nil
+	}
+
+	if ext == "" {
+		return "", mismatch(ExtensionRuleMissing)
+	}
+	for _, k := range known {
+		if strings.EqualFold(ext, k) {
+			return ext, nil
+		}
+	}
+	return "", mismatch(ExtensionRuleMismatch)
+}
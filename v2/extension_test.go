@@ -0,0 +1,55 @@
+package toolbox
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTools_UploadFilesExtensionPolicy(t *testing.T) {
+	pngData := testPNG(t)
+
+	extensionTests := []struct {
+		name         string
+		policy       ExtensionPolicy
+		fileName     string
+		data         []byte
+		expectedName string
+		expectedRule ExtensionRule
+	}{
+		{name: "ignore keeps mismatch", policy: ExtensionIgnore, fileName: "invoice.pdf", data: pngData, expectedName: "invoice.pdf"},
+		{name: "reject mismatch", policy: ExtensionReject, fileName: "invoice.pdf", data: pngData, expectedRule: ExtensionRuleMismatch},
+		{name: "reject missing", policy: ExtensionReject, fileName: "invoice", data: pngData, expectedRule: ExtensionRuleMissing},
+		{name: "reject allows matching", policy: ExtensionReject, fileName: "photo.PNG", data: pngData, expectedName: "photo.PNG"},
+		{name: "reject allows text", policy: ExtensionReject, fileName: "data.csv", data: []byte("a,b\n1,2\n"), expectedName: "data.csv"},
+		{name: "rewrite mismatch", policy: ExtensionRewrite, fileName: "invoice.pdf", data: pngData, expectedName: "invoice.png"},
+		{name: "rewrite missing", policy: ExtensionRewrite, fileName: "invoice", data: pngData, expectedName: "invoice.png"},
+	}
+
+	for _, e := range extensionTests {
+		var testTools Tools
+		testTools.Storage = &MemoryStorage{}
+		testTools.UploadedFile.ExtensionPolicy = e.policy
+
+		req := newMultipartRequest(t, testPart{field: "file", fileName: e.fileName, data: e.data})
+		files, err := testTools.UploadFiles(req, "uploads", false)
+
+		if e.expectedRule != "" {
+			var mismatch *ExtensionMismatchError
+			if !errors.As(err, &mismatch) {
+				t.Errorf("%s: expected *ExtensionMismatchError, got %v", e.name, err)
+				continue
+			}
+			if mismatch.Rule != e.expectedRule {
+				t.Errorf("%s: wrong rule. wanted=%s, got=%s", e.name, e.expectedRule, mismatch.Rule)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+		if files[0].NewFileName != e.expectedName {
+			t.Errorf("%s: wrong file name. wanted=%s, got=%s", e.name, e.expectedName, files[0].NewFileName)
+		}
+	}
+}
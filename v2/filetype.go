@@ -0,0 +1,327 @@
+package toolbox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// sniffLen is how many leading bytes of a file are looked at to detect its type. It is larger
+// than the 512 bytes used by http.DetectContentType so that formats built on zip, such as
+// DOCX, can be told apart by the names of the entries at the start of the archive.
+const sniffLen = 8192
+
+// FileType describes a file format that can be recognised from its leading bytes.
+type FileType struct {
+	// MIMEType is reported when the type matches.
+	MIMEType string
+	// Extensions lists the file name extensions used for the type, with the leading dot.
+	// The first one is the canonical extension.
+	Extensions []string
+	// Magic is compared with the bytes of the file starting at Offset. It is only used
+	// when Match is nil.
+	Offset int
+	Magic  []byte
+	// Match reports whether b, the first bytes of a file, belong to the type.
+	Match func(b []byte) bool
+}
+
+func (ft FileType) matches(b []byte) bool {
+	if ft.Match != nil {
+		return ft.Match(b)
+	}
+	return len(ft.Magic) > 0 && hasMagic(b, ft.Offset, ft.Magic)
+}
+
+// FileTypes is a registry of file signatures used to detect the type of uploaded files.
+// Types registered later are checked first, so a registered type can override a built in one.
+type FileTypes struct {
+	mu    sync.RWMutex
+	types []FileType
+}
+
+// DefaultFileTypes is the registry used when Tools.FileTypes is nil. It starts out with the
+// built in types, covering common image, audio, video, archive and office formats.
+var DefaultFileTypes = NewFileTypes()
+
+// NewFileTypes returns a registry holding the built in file types.
+func NewFileTypes() *FileTypes {
+	r := &FileTypes{}
+	for _, ft := range builtinFileTypes {
+		r.Register(ft)
+	}
+	return r
+}
+
+// Register adds ft to the registry.
+func (r *FileTypes) Register(ft FileType) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.types = append(r.types, ft)
+}
+
+// Detect returns the MIME type of the file starting with b. When no registered type matches,
+// it falls back to http.DetectContentType, so the result is never empty.
+func (r *FileTypes) Detect(b []byte) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i := len(r.types) - 1; i >= 0; i-- {
+		if r.types[i].matches(b) {
+			return r.types[i].MIMEType
+		}
+	}
+	return http.DetectContentType(b)
+}
+
+// RegisterFileType adds ft to DefaultFileTypes.
+func RegisterFileType(ft FileType) {
+	DefaultFileTypes.Register(ft)
+}
+
+// DetectContentType returns the MIME type of the file starting with b, using DefaultFileTypes.
+func DetectContentType(b []byte) string {
+	return DefaultFileTypes.Detect(b)
+}
+
+// fileTypes returns the registry configured on t, or DefaultFileTypes.
+func (t *Tools) fileTypes() *FileTypes {
+	if t.FileTypes != nil {
+		return t.FileTypes
+	}
+	return DefaultFileTypes
+}
+
+// isAllowedFileType reports whether fileType is in UploadedFile.AllowedFileTypes. Parameters
+// such as "; charset=utf-8" are ignored unless the allowed type spells them out. An empty
+// list allows every type.
+func (t *Tools) isAllowedFileType(fileType string) bool {
+	if len(t.UploadedFile.AllowedFileTypes) == 0 {
+		return true
+	}
+	for _, allowed := range t.UploadedFile.AllowedFileTypes {
+		if strings.EqualFold(fileType, allowed) || strings.EqualFold(baseMediaType(fileType), allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// baseMediaType strips any parameters from a MIME type.
+func baseMediaType(s string) string {
+	if mt, _, err := mime.ParseMediaType(s); err == nil {
+		return mt
+	}
+	base, _, _ := strings.Cut(s, ";")
+	return strings.ToLower(strings.TrimSpace(base))
+}
+
+func hasMagic(b []byte, offset int, magic []byte) bool {
+	return len(b) >= offset+len(magic) && bytes.Equal(b[offset:offset+len(magic)], magic)
+}
+
+// magic matches any of the given signatures at the start of the file.
+func magic(sigs ...string) func([]byte) bool {
+	return func(b []byte) bool {
+		for _, sig := range sigs {
+			if hasMagic(b, 0, []byte(sig)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// riff matches a RIFF container holding the given form type, such as "WAVE".
+func riff(form string) func([]byte) bool {
+	return func(b []byte) bool {
+		return hasMagic(b, 0, []byte("RIFF")) && hasMagic(b, 8, []byte(form))
+	}
+}
+
+// ftyp matches an ISO base media file (MP4, HEIF and relatives) whose major or compatible
+// brands include one of brands.
+func ftyp(brands ...string) func([]byte) bool {
+	return func(b []byte) bool {
+		if !hasMagic(b, 4, []byte("ftyp")) {
+			return false
+		}
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 16 || size > len(b) {
+			size = min(len(b), 64)
+		}
+		for off := 8; off+4 <= size; off += 4 {
+			// the four bytes at offset 12 are the minor version, not a brand
+			if off == 12 {
+				continue
+			}
+			for _, brand := range brands {
+				if string(b[off:off+4]) == brand {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// zipEntry matches a zip archive that has an entry whose name starts with prefix within
+// the sniffed bytes, which is how the OOXML formats are recognised.
+func zipEntry(prefix string) func([]byte) bool {
+	return func(b []byte) bool {
+		for _, name := range zipEntryNames(b) {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// zipEntryNames returns the names in the zip local file headers found within b, following
+// them from the start of the archive.
+func zipEntryNames(b []byte) []string {
+	signature := []byte("PK\x03\x04")
+	var names []string
+	for off := 0; off+30 <= len(b) && hasMagic(b, off, signature); {
+		flags := binary.LittleEndian.Uint16(b[off+6:])
+		compressedSize := int64(binary.LittleEndian.Uint32(b[off+18:]))
+		nameLen := int(binary.LittleEndian.Uint16(b[off+26:]))
+		extraLen := int(binary.LittleEndian.Uint16(b[off+28:]))
+		if off+30+nameLen > len(b) {
+			break
+		}
+		names = append(names, string(b[off+30:off+30+nameLen]))
+
+		data := off + 30 + nameLen + extraLen
+		if data >= len(b) {
+			break
+		}
+		if flags&0x08 == 0 {
+			if int64(data)+compressedSize > int64(len(b)) {
+				break
+			}
+			off = data + int(compressedSize)
+			continue
+		}
+		// the sizes follow the data in a data descriptor, so look for the next header instead
+		next := bytes.Index(b[data:], signature)
+		if next < 0 {
+			break
+		}
+		off = data + next
+	}
+	return names
+}
+
+// zipMimetype matches the OpenDocument and EPUB convention of an uncompressed first entry
+// named "mimetype" that holds the MIME type of the document.
+func zipMimetype(mimeType string) func([]byte) bool {
+	return func(b []byte) bool {
+		return hasMagic(b, 0, []byte("PK\x03\x04")) && hasMagic(b, 30, []byte("mimetype")) &&
+			hasMagic(b, 38, []byte(mimeType))
+	}
+}
+
+// mpegAudio matches an MP3 file, either tagged with ID3 or starting with a layer III frame.
+func mpegAudio(b []byte) bool {
+	if hasMagic(b, 0, []byte("ID3")) {
+		return true
+	}
+	return len(b) >= 2 && b[0] == 0xFF && b[1]&0xE0 == 0xE0 && b[1]&0x06 == 0x02
+}
+
+// adtsAudio matches an AAC stream with ADTS frame headers.
+func adtsAudio(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0xFF && b[1]&0xF6 == 0xF0
+}
+
+// ebml matches a Matroska container whose doc type is docType.
+func ebml(docType string) func([]byte) bool {
+	return func(b []byte) bool {
+		head := b[:min(len(b), 64)]
+		return hasMagic(b, 0, []byte("\x1A\x45\xDF\xA3")) && bytes.Contains(head, []byte(docType))
+	}
+}
+
+// builtinFileTypes are registered in every new FileTypes. More general types come before the
+// more specific ones built on them, since the registry checks the last registered types first.
+var builtinFileTypes = []FileType{
+	// images
+	{MIMEType: "image/jpeg", Extensions: []string{".jpg", ".jpeg", ".jpe"}, Magic: []byte("\xFF\xD8\xFF")},
+	{MIMEType: "image/png", Extensions: []string{".png"}, Magic: []byte("\x89PNG\r\n\x1A\n")},
+	{MIMEType: "image/gif", Extensions: []string{".gif"}, Match: magic("GIF87a", "GIF89a")},
+	{MIMEType: "image/webp", Extensions: []string{".webp"}, Match: riff("WEBP")},
+	{MIMEType: "image/bmp", Extensions: []string{".bmp"}, Magic: []byte("BM")},
+	{MIMEType: "image/tiff", Extensions: []string{".tif", ".tiff"}, Match: magic("II*\x00", "MM\x00*")},
+	{MIMEType: "image/x-icon", Extensions: []string{".ico"}, Magic: []byte("\x00\x00\x01\x00")},
+	{MIMEType: "image/vnd.adobe.photoshop", Extensions: []string{".psd"}, Magic: []byte("8BPS")},
+	{MIMEType: "image/jxl", Extensions: []string{".jxl"}, Match: magic("\xFF\x0A", "\x00\x00\x00\x0CJXL \x0D\x0A\x87\x0A")},
+	{MIMEType: "image/heif", Extensions: []string{".heif", ".heifs"}, Match: ftyp("mif1", "msf1")},
+	{MIMEType: "image/heic", Extensions: []string{".heic", ".heics"}, Match: ftyp("heic", "heix", "heim", "heis", "hevc", "hevx", "hevm", "hevs")},
+	{MIMEType: "image/avif", Extensions: []string{".avif"}, Match: ftyp("avif", "avis")},
+
+	// audio
+	{MIMEType: "audio/mpeg", Extensions: []string{".mp3"}, Match: mpegAudio},
+	{MIMEType: "audio/aac", Extensions: []string{".aac"}, Match: adtsAudio},
+	{MIMEType: "audio/flac", Extensions: []string{".flac"}, Magic: []byte("fLaC")},
+	{MIMEType: "audio/ogg", Extensions: []string{".ogg", ".oga"}, Magic: []byte("OggS")},
+	{MIMEType: "audio/opus", Extensions: []string{".opus"}, Match: func(b []byte) bool {
+		return hasMagic(b, 0, []byte("OggS")) && hasMagic(b, 28, []byte("OpusHead"))
+	}},
+	{MIMEType: "audio/wav", Extensions: []string{".wav"}, Match: riff("WAVE")},
+	{MIMEType: "audio/aiff", Extensions: []string{".aiff", ".aif", ".aifc"}, Match: func(b []byte) bool {
+		return hasMagic(b, 0, []byte("FORM")) && (hasMagic(b, 8, []byte("AIFF")) || hasMagic(b, 8, []byte("AIFC")))
+	}},
+	{MIMEType: "audio/amr", Extensions: []string{".amr"}, Magic: []byte("#!AMR")},
+	{MIMEType: "audio/midi", Extensions: []string{".mid", ".midi"}, Magic: []byte("MThd")},
+
+	// video
+	{MIMEType: "video/mp4", Extensions: []string{".mp4", ".m4v"}, Match: ftyp("isom", "iso2", "iso4", "iso5", "iso6", "mp41", "mp42", "avc1", "dash", "M4V ", "mmp4")},
+	{MIMEType: "audio/mp4", Extensions: []string{".m4a", ".m4b"}, Match: ftyp("M4A ", "M4B ")},
+	{MIMEType: "video/quicktime", Extensions: []string{".mov", ".qt"}, Match: ftyp("qt  ")},
+	{MIMEType: "video/3gpp", Extensions: []string{".3gp"}, Match: ftyp("3gp4", "3gp5", "3gp6", "3ge6", "3gg6")},
+	{MIMEType: "video/3gpp2", Extensions: []string{".3g2"}, Match: ftyp("3g2a", "3g2b", "3g2c")},
+	{MIMEType: "video/x-matroska", Extensions: []string{".mkv", ".mka"}, Match: ebml("matroska")},
+	{MIMEType: "video/webm", Extensions: []string{".webm"}, Match: ebml("webm")},
+	{MIMEType: "video/x-msvideo", Extensions: []string{".avi"}, Match: riff("AVI ")},
+	{MIMEType: "video/x-flv", Extensions: []string{".flv"}, Magic: []byte("FLV\x01")},
+	{MIMEType: "video/mpeg", Extensions: []string{".mpg", ".mpeg"}, Match: magic("\x00\x00\x01\xBA", "\x00\x00\x01\xB3")},
+
+	// archives
+	{MIMEType: "application/zip", Extensions: []string{".zip"}, Match: magic("PK\x03\x04", "PK\x05\x06")},
+	{MIMEType: "application/gzip", Extensions: []string{".gz", ".tgz"}, Magic: []byte("\x1F\x8B\x08")},
+	{MIMEType: "application/x-bzip2", Extensions: []string{".bz2"}, Magic: []byte("BZh")},
+	{MIMEType: "application/x-xz", Extensions: []string{".xz"}, Magic: []byte("\xFD7zXZ\x00")},
+	{MIMEType: "application/zstd", Extensions: []string{".zst"}, Magic: []byte("\x28\xB5\x2F\xFD")},
+	{MIMEType: "application/x-7z-compressed", Extensions: []string{".7z"}, Magic: []byte("7z\xBC\xAF\x27\x1C")},
+	{MIMEType: "application/vnd.rar", Extensions: []string{".rar"}, Magic: []byte("Rar!\x1A\x07")},
+	{MIMEType: "application/x-tar", Extensions: []string{".tar"}, Offset: 257, Magic: []byte("ustar")},
+
+	// documents
+	{MIMEType: "application/pdf", Extensions: []string{".pdf"}, Magic: []byte("%PDF-")},
+	{MIMEType: "application/rtf", Extensions: []string{".rtf"}, Magic: []byte("{\\rtf")},
+	{MIMEType: "application/x-ole-storage", Extensions: []string{".doc", ".xls", ".ppt", ".msg", ".msi"}, Magic: []byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1")},
+	{MIMEType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", Extensions: []string{".docx"}, Match: zipEntry("word/")},
+	{MIMEType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Extensions: []string{".xlsx"}, Match: zipEntry("xl/")},
+	{MIMEType: "application/vnd.openxmlformats-officedocument.presentationml.presentation", Extensions: []string{".pptx"}, Match: zipEntry("ppt/")},
+	{MIMEType: "application/vnd.oasis.opendocument.text", Extensions: []string{".odt"}, Match: zipMimetype("application/vnd.oasis.opendocument.text")},
+	{MIMEType: "application/vnd.oasis.opendocument.spreadsheet", Extensions: []string{".ods"}, Match: zipMimetype("application/vnd.oasis.opendocument.spreadsheet")},
+	{MIMEType: "application/vnd.oasis.opendocument.presentation", Extensions: []string{".odp"}, Match: zipMimetype("application/vnd.oasis.opendocument.presentation")},
+	{MIMEType: "application/epub+zip", Extensions: []string{".epub"}, Match: zipMimetype("application/epub+zip")},
+
+	// data and binaries
+	{MIMEType: "application/vnd.sqlite3", Extensions: []string{".sqlite", ".sqlite3", ".db"}, Magic: []byte("SQLite format 3\x00")},
+	{MIMEType: "application/vnd.apache.parquet", Extensions: []string{".parquet"}, Magic: []byte("PAR1")},
+	{MIMEType: "application/wasm", Extensions: []string{".wasm"}, Magic: []byte("\x00asm")},
+	{MIMEType: "application/x-elf", Extensions: []string{".elf", ".so", ".o"}, Magic: []byte("\x7FELF")},
+	{MIMEType: "application/vnd.microsoft.portable-executable", Extensions: []string{".exe", ".dll"}, Magic: []byte("MZ")},
+
+	// fonts
+	{MIMEType: "font/woff", Extensions: []string{".woff"}, Magic: []byte("wOFF")},
+	{MIMEType: "font/woff2", Extensions: []string{".woff2"}, Magic: []byte("wOF2")},
+	{MIMEType: "font/ttf", Extensions: []string{".ttf"}, Magic: []byte("\x00\x01\x00\x00\x00")},
+	{MIMEType: "font/otf", Extensions: []string{".otf"}, Magic: []byte("OTTO")},
+}
@@ -0,0 +1,151 @@
+package toolbox
+
+import (
+	"archive/zip"
+	"bytes"
+	"hash/crc32"
+	"testing"
+)
+
+// testZip builds a zip archive holding empty entries with the given names. The first entry
+// is stored uncompressed so that a "mimetype" entry sits where OpenDocument readers expect it.
+func testZip(t *testing.T, names []string, firstContent string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i, name := range names {
+		method := zip.Deflate
+		content := "<xml/>"
+		if i == 0 {
+			method = zip.Store
+			content = firstContent
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testZipSized builds a zip archive of stored entries whose sizes are in their local headers,
+// as written by office suites, rather than in data descriptors after the data.
+func testZipSized(t *testing.T, names []string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	content := []byte("<xml/>")
+	for _, name := range names {
+		w, err := zw.CreateRaw(&zip.FileHeader{
+			Name:               name,
+			Method:             zip.Store,
+			CRC32:              crc32.ChecksumIEEE(content),
+			CompressedSize64:   uint64(len(content)),
+			UncompressedSize64: uint64(len(content)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write(content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testFtyp builds the start of an ISO base media file with the given major and compatible brands.
+func testFtyp(major string, compatible ...string) []byte {
+	size := 16 + 4*len(compatible)
+	b := []byte{0, 0, 0, byte(size)}
+	b = append(b, "ftyp"+major+"\x00\x00\x00\x00"...)
+	for _, c := range compatible {
+		b = append(b, c...)
+	}
+	return append(b, make([]byte, 16)...)
+}
+
+func TestFileTypes_Detect(t *testing.T) {
+	detectTests := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{name: "png", data: testPNG(t), expected: "image/png"},
+		{name: "docx", data: testZip(t, []string{"[Content_Types].xml", "_rels/.rels", "word/document.xml"}, "<Types/>"), expected: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{name: "xlsx", data: testZip(t, []string{"[Content_Types].xml", "xl/workbook.xml"}, "<Types/>"), expected: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{name: "odt", data: testZip(t, []string{"mimetype", "content.xml"}, "application/vnd.oasis.opendocument.text"), expected: "application/vnd.oasis.opendocument.text"},
+		{name: "plain zip", data: testZip(t, []string{"notes.txt"}, "hello"), expected: "application/zip"},
+		{name: "zip with xl in a name", data: testZip(t, []string{"pixl/photo.txt", "docs/ppt/notes.txt"}, "hello"), expected: "application/zip"},
+		{name: "zip with xl in its data", data: testZip(t, []string{"notes.txt", "more.txt"}, "see xl/ and word/"), expected: "application/zip"},
+		{name: "xlsx without descriptors", data: testZipSized(t, []string{"[Content_Types].xml", "xl/workbook.xml"}), expected: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{name: "heic", data: testFtyp("heic", "mif1", "heic"), expected: "image/heic"},
+		{name: "avif", data: testFtyp("avif", "avif", "mif1", "miaf"), expected: "image/avif"},
+		{name: "mp4", data: testFtyp("isom", "isom", "iso2", "mp41"), expected: "video/mp4"},
+		{name: "m4a", data: testFtyp("M4A ", "M4A ", "isom", "mp42"), expected: "audio/mp4"},
+		{name: "parquet", data: []byte("PAR1\x15\x04\x15\x10"), expected: "application/vnd.apache.parquet"},
+		{name: "flac", data: []byte("fLaC\x00\x00\x00\x22"), expected: "audio/flac"},
+		{name: "mp3 with id3", data: []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), expected: "audio/mpeg"},
+		{name: "mp3 frame", data: []byte("\xFF\xFB\x90\x44\x00\x00"), expected: "audio/mpeg"},
+		{name: "opus", data: append([]byte("OggS\x00\x02"), append(make([]byte, 22), "OpusHead"...)...), expected: "audio/opus"},
+		{name: "wav", data: []byte("RIFF\x24\x08\x00\x00WAVEfmt "), expected: "audio/wav"},
+		{name: "7z", data: []byte("7z\xBC\xAF\x27\x1C\x00\x04"), expected: "application/x-7z-compressed"},
+		{name: "text falls back to net/http", data: []byte("just some text"), expected: "text/plain; charset=utf-8"},
+	}
+
+	types := NewFileTypes()
+	for _, e := range detectTests {
+		if got := types.Detect(e.data); got != e.expected {
+			t.Errorf("%s: wrong type. wanted=%s, got=%s", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestFileTypes_Register(t *testing.T) {
+	types := NewFileTypes()
+	types.Register(FileType{MIMEType: "application/x-custom", Extensions: []string{".cst"}, Magic: []byte("CUST")})
+	// a registered type wins over a built in one matching the same bytes
+	types.Register(FileType{MIMEType: "application/x-special-pdf", Match: func(b []byte) bool {
+		return bytes.HasPrefix(b, []byte("%PDF-1.7 special"))
+	}})
+
+	if got := types.Detect([]byte("CUST\x01\x02")); got != "application/x-custom" {
+		t.Errorf("wrong type for custom signature: %s", got)
+	}
+	if got := types.Detect([]byte("%PDF-1.7 special")); got != "application/x-special-pdf" {
+		t.Errorf("registered type did not take precedence: %s", got)
+	}
+	if got := types.Detect([]byte("%PDF-1.4")); got != "application/pdf" {
+		t.Errorf("wrong type for pdf: %s", got)
+	}
+	if got := DetectContentType([]byte("CUST")); got == "application/x-custom" {
+		t.Error("registering on a new registry changed DefaultFileTypes")
+	}
+}
+
+func TestTools_UploadFilesFileTypes(t *testing.T) {
+	docx := testZip(t, []string{"[Content_Types].xml", "word/document.xml"}, "<Types/>")
+
+	var testTools Tools
+	testTools.Storage = &MemoryStorage{}
+	testTools.UploadedFile.AllowedFileTypes = []string{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "text/plain"}
+
+	req := newMultipartRequest(t,
+		testPart{field: "file", fileName: "report.docx", data: docx},
+		testPart{field: "file", fileName: "notes.txt", data: []byte("plain text")},
+	)
+	files, err := testTools.UploadFiles(req, "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("wrong number of files. wanted=2, got=%d", len(files))
+	}
+
+	req = newMultipartRequest(t, testPart{field: "file", fileName: "archive.zip", data: testZip(t, []string{"a.txt"}, "a")})
+	if _, err := testTools.UploadFiles(req, "uploads"); err == nil {
+		t.Error("expected plain zip to be rejected")
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/wtran29/toolbox/v2
 
 go 1.22.1
+
+require golang.org/x/text v0.21.0
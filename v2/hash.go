@@ -0,0 +1,64 @@
+package toolbox
+
+import (
+	"context"
+	"crypto"
+	_ "crypto/md5"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+)
+
+// hashAlgorithm returns the digest configured in UploadedFile.HashAlgorithm, which
+// defaults to SHA-256.
+func (t *Tools) hashAlgorithm() (crypto.Hash, error) {
+	alg := t.UploadedFile.HashAlgorithm
+	if alg == 0 {
+		alg = crypto.SHA256
+	}
+	if !alg.Available() {
+		return 0, fmt.Errorf("hash algorithm %s is not available", alg)
+	}
+	return alg, nil
+}
+
+// contentAddressedName returns the name a file with the hex digest sum is stored under,
+// sharded into two levels of directories: ab/cd/abcdef...
+func contentAddressedName(sum string) string {
+	return path.Join(sum[:2], sum[2:4], sum)
+}
+
+// putContentAddressed stores r in uploadDir under its own digest. The digest is only known
+// once all of r has been read, so r is spooled to a temporary file first while h hashes it.
+// If a file with the same digest is already stored, it is kept and duplicate is true.
+func (t *Tools) putContentAddressed(ctx context.Context, r io.Reader, h hash.Hash, uploadDir string) (name string, size int64, duplicate bool, err error) {
+	tmp, size, err := spoolFile(io.TeeReader(r, h))
+	if err != nil {
+		return "", 0, false, err
+	}
+	defer removeSpool(tmp)
+
+	name = contentAddressedName(hex.EncodeToString(h.Sum(nil)))
+	key := storageKey(uploadDir, name)
+
+	_, err = t.storage().Stat(ctx, key)
+	if err == nil {
+		return name, size, true, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", 0, false, err
+	}
+
+	_, err = t.storage().Put(ctx, key, tmp)
+	if err != nil {
+		return "", 0, false, err
+	}
+	return name, size, false, nil
+}
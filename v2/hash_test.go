@@ -0,0 +1,73 @@
+package toolbox
+
+import (
+	"context"
+	"crypto"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"testing"
+)
+
+var checksumTests = []struct {
+	name      string
+	algorithm crypto.Hash
+	sum       func([]byte) string
+}{
+	{name: "default", sum: func(b []byte) string { s := sha256.Sum256(b); return hex.EncodeToString(s[:]) }},
+	{name: "md5", algorithm: crypto.MD5, sum: func(b []byte) string { s := md5.Sum(b); return hex.EncodeToString(s[:]) }},
+}
+
+func TestTools_UploadFilesChecksum(t *testing.T) {
+	data := testPNG(t)
+
+	for _, e := range checksumTests {
+		for _, stream := range []bool{false, true} {
+			var testTools Tools
+			testTools.Storage = &MemoryStorage{}
+			testTools.UploadedFile.HashAlgorithm = e.algorithm
+			testTools.UploadedFile.Stream = stream
+
+			req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", data: data})
+			files, err := testTools.UploadFiles(req, "uploads")
+			if err != nil {
+				t.Fatalf("%s: %s", e.name, err)
+			}
+			if files[0].Checksum != e.sum(data) {
+				t.Errorf("%s: wrong checksum. wanted=%s, got=%s", e.name, e.sum(data), files[0].Checksum)
+			}
+		}
+	}
+}
+
+func TestTools_UploadFilesContentAddressed(t *testing.T) {
+	data := testPNG(t)
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	expectedName := path.Join(digest[:2], digest[2:4], digest)
+
+	var store MemoryStorage
+	var testTools Tools
+	testTools.Storage = &store
+	testTools.UploadedFile.ContentAddressed = true
+
+	for i, duplicate := range []bool{false, true} {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", data: data})
+		files, err := testTools.UploadFiles(req, "docs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files[0].NewFileName != expectedName {
+			t.Errorf("upload %d: wrong name. wanted=%s, got=%s", i, expectedName, files[0].NewFileName)
+		}
+		if files[0].Duplicate != duplicate {
+			t.Errorf("upload %d: wrong duplicate flag. wanted=%t, got=%t", i, duplicate, files[0].Duplicate)
+		}
+	}
+
+	list, _ := store.List(context.Background(), "docs/")
+	if len(list) != 1 {
+		t.Errorf("expected identical uploads to be stored once, got %d files", len(list))
+	}
+}
@@ -0,0 +1,462 @@
+package toolbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImageOptions configures the processing of uploaded JPEG, PNG and GIF images. The zero
+// value leaves images untouched.
+type ImageOptions struct {
+	// MaxPixels rejects images with more than this many pixels (width times height) with an
+	// *ImageTooLargeError. Only the image header is read for this check, so it stops
+	// decompression bombs before they are decoded. The frames of an animated GIF are added up,
+	// as each of them may be decoded. Zero means no limit.
+	MaxPixels int
+	// StripMetadata re-encodes images so EXIF data, including GPS positions, and other
+	// embedded metadata is dropped. JPEG images are rotated according to their EXIF
+	// orientation first, so they still display the right way up.
+	StripMetadata bool
+	// Thumbnails lists the thumbnails to create for every image.
+	Thumbnails []ThumbnailSize
+	// JPEGQuality is the quality, from 1 to 100, used when encoding JPEG images. It defaults to 90.
+	JPEGQuality int
+}
+
+// ThumbnailSize describes a thumbnail to create. The image is scaled down to fit within Width
+// and Height, keeping its aspect ratio; a zero Width or Height leaves that side unconstrained.
+// Images are never scaled up.
+type ThumbnailSize struct {
+	// Name is added to the file name of the thumbnail, as in photo_small.jpg.
+	Name   string
+	Width  int
+	Height int
+}
+
+// DerivedFile is a file created from an upload, such as a thumbnail, and stored next to it.
+type DerivedFile struct {
+	// Name is the name of the ThumbnailSize the file was made for.
+	Name        string
+	NewFileName string
+	FileSize    int64
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// ImageTooLargeError is returned when an uploaded image has more pixels than ImageOptions.MaxPixels.
+type ImageTooLargeError struct {
+	FileName string
+	Limit    int64
+	Pixels   int64
+}
+
+func (e *ImageTooLargeError) Error() string {
+	return fmt.Sprintf("uploaded image %q is too large: got %d pixels, limit is %d", e.FileName, e.Pixels, e.Limit)
+}
+
+// processedImageTypes are the types ImageOptions applies to.
+var processedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// applies reports whether o has any work to do for a file of contentType.
+func (o *ImageOptions) applies(contentType string) bool {
+	return processedImageTypes[contentType] && (o.MaxPixels > 0 || o.StripMetadata || len(o.Thumbnails) > 0)
+}
+
+func (o *ImageOptions) jpegQuality() int {
+	if o.JPEGQuality > 0 && o.JPEGQuality <= 100 {
+		return o.JPEGQuality
+	}
+	return 90
+}
+
+// thumbnail is an encoded thumbnail waiting to be stored.
+type thumbnail struct {
+	size          ThumbnailSize
+	data          []byte
+	width, height int
+}
+
+// processImage runs the UploadedFile.Image pipeline over an image spooled to f. It returns
+// the content to store in place of the upload, which is f itself unless the image was
+// re-encoded, and the thumbnails to store next to it.
+func (t *Tools) processImage(f *os.File, fileName, contentType string) (io.Reader, []thumbnail, error) {
+	opts := &t.UploadedFile.Image
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to decode image %q: %w", fileName, err)
+	}
+	pixels := int64(config.Width) * int64(config.Height)
+	if contentType == "image/gif" && opts.MaxPixels > 0 {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		pixels, err = gifPixels(bufio.NewReader(f), int64(opts.MaxPixels))
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to decode image %q: %w", fileName, err)
+		}
+	}
+	if opts.MaxPixels > 0 && pixels > int64(opts.MaxPixels) {
+		return nil, nil, &ImageTooLargeError{FileName: fileName, Limit: int64(opts.MaxPixels), Pixels: pixels}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	if !opts.StripMetadata && len(opts.Thumbnails) == 0 {
+		return f, nil, nil
+	}
+
+	// img is the picture the thumbnails are made from, the first frame of a GIF
+	var img image.Image
+	var stripped bytes.Buffer
+	if contentType == "image/gif" {
+		var g *gif.GIF
+		var first image.Image
+		if opts.StripMetadata {
+			g, err = gif.DecodeAll(f)
+			if err == nil {
+				first = g.Image[0]
+			}
+		} else {
+			// the thumbnails only need the first frame
+			first, err = gif.Decode(f)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to decode image %q: %w", fileName, err)
+		}
+		canvas := image.NewRGBA(image.Rect(0, 0, config.Width, config.Height))
+		draw.Draw(canvas, first.Bounds(), first, first.Bounds().Min, draw.Over)
+		img = canvas
+		// the GIF encoder only writes the frames and the loop count, leaving out
+		// comments and application extensions
+		if opts.StripMetadata {
+			err = gif.EncodeAll(&stripped, g)
+		}
+	} else {
+		header := make([]byte, 64*1024)
+		n, _ := io.ReadFull(f, header)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		img, _, err = image.Decode(f)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to decode image %q: %w", fileName, err)
+		}
+		if contentType == "image/jpeg" {
+			img = orient(img, jpegOrientation(header[:n]))
+		}
+		if opts.StripMetadata {
+			err = t.encodeImage(&stripped, img, contentType)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var thumbs []thumbnail
+	for _, size := range opts.Thumbnails {
+		thumb := scaleToFit(img, size.Width, size.Height)
+		var buf bytes.Buffer
+		if err := t.encodeImage(&buf, thumb, contentType); err != nil {
+			return nil, nil, err
+		}
+		thumbs = append(thumbs, thumbnail{
+			size:   size,
+			data:   buf.Bytes(),
+			width:  thumb.Bounds().Dx(),
+			height: thumb.Bounds().Dy(),
+		})
+	}
+
+	if opts.StripMetadata {
+		return &stripped, thumbs, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	return f, thumbs, nil
+}
+
+// gifPixels adds up the pixels of every frame of the GIF read from r, going by the image
+// descriptors alone, so none of the frames is decompressed. It stops counting once the total
+// goes over limit.
+func gifPixels(r *bufio.Reader, limit int64) (int64, error) {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	if err := skipColorTable(r, header[10]); err != nil {
+		return 0, err
+	}
+
+	var pixels int64
+	for pixels <= limit {
+		block, err := r.ReadByte()
+		if err == io.EOF && pixels > 0 {
+			// some encoders leave out the trailer
+			return pixels, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch block {
+		case 0x21: // extension: a label, then data sub-blocks
+			if _, err := r.ReadByte(); err != nil {
+				return 0, err
+			}
+			if err := skipSubBlocks(r); err != nil {
+				return 0, err
+			}
+		case 0x2c: // image descriptor, followed by the LZW code size and the image data
+			desc := make([]byte, 9)
+			if _, err := io.ReadFull(r, desc); err != nil {
+				return 0, err
+			}
+			pixels += int64(binary.LittleEndian.Uint16(desc[4:6])) * int64(binary.LittleEndian.Uint16(desc[6:8]))
+			if err := skipColorTable(r, desc[8]); err != nil {
+				return 0, err
+			}
+			if _, err := r.ReadByte(); err != nil {
+				return 0, err
+			}
+			if err := skipSubBlocks(r); err != nil {
+				return 0, err
+			}
+		case 0x3b: // trailer
+			return pixels, nil
+		default:
+			return 0, fmt.Errorf("gif: unknown block type 0x%02x", block)
+		}
+	}
+	return pixels, nil
+}
+
+// skipColorTable skips the color table that flags, from a GIF screen or image descriptor,
+// says follows.
+func skipColorTable(r *bufio.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	_, err := r.Discard(3 << ((flags & 0x07) + 1))
+	return err
+}
+
+// skipSubBlocks skips GIF data sub-blocks up to the empty block ending them.
+func skipSubBlocks(r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := r.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *Tools) encodeImage(w io.Writer, img image.Image, contentType string) error {
+	switch contentType {
+	case "image/jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: t.UploadedFile.Image.jpegQuality()})
+	case "image/gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return png.Encode(w, img)
+	}
+}
+
+// storeThumbnails saves the thumbnails next to uploadedFile in uploadDir, naming each
+// after it, and records them as derived files.
+func (t *Tools) storeThumbnails(ctx context.Context, state *uploadState, uploadedFile *UploadedFile, uploadDir string, thumbs []thumbnail) error {
+	ext := filepath.Ext(uploadedFile.NewFileName)
+	stem := strings.TrimSuffix(uploadedFile.NewFileName, ext)
+	for _, thumb := range thumbs {
+		name := fmt.Sprintf("%s_%s%s", stem, thumb.size.Name, ext)
+		key, err := confinedKey(uploadDir, name)
+		if err != nil {
+			return err
+		}
+		size, err := t.storage().Put(ctx, key, bytes.NewReader(thumb.data))
+		if err != nil {
+			return err
+		}
+		if !uploadedFile.Duplicate {
+			state.addSaved(key)
+		}
+		uploadedFile.Derived = append(uploadedFile.Derived, DerivedFile{
+			Name:        thumb.size.Name,
+			NewFileName: name,
+			FileSize:    size,
+			ContentType: uploadedFile.ContentType,
+			Width:       thumb.width,
+			Height:      thumb.height,
+		})
+	}
+	return nil
+}
+
+// scaleToFit scales img down to fit within width and height, averaging the source pixels
+// covered by each destination pixel. img is returned as it is when it already fits.
+func scaleToFit(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if width > 0 && dw > width {
+		dw, dh = width, max(1, sh*width/sw)
+	}
+	if height > 0 && dh > height {
+		dw, dh = max(1, sw*height/sh), height
+	}
+	if dw == sw && dh == sh {
+		return img
+	}
+
+	// work on premultiplied RGBA so transparent pixels do not bleed their color
+	src := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint32(p[0])
+					g += uint32(p[1])
+					bl += uint32(p[2])
+					a += uint32(p[3])
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(bl / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation, from 1 to 8, found in the APP1 segment at
+// the start of a JPEG file, or 1 when there is none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		// the image data starts at SOS, and the metadata comes before it
+		if marker == 0xDA || length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of a TIFF structure.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		entry := ifd + 2 + e*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orient turns img so that it displays the right way up for EXIF orientation o.
+func orient(img image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch o {
+			case 2: // mirrored
+				sx, sy = w-1-dx, dy
+			case 3: // upside down
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // upside down and mirrored
+				sx, sy = dx, h-1-dy
+			case 5: // mirrored along the top-left diagonal
+				sx, sy = dy, dx
+			case 6: // rotate 90 degrees clockwise
+				sx, sy = dy, h-1-dx
+			case 7: // mirrored along the top-right diagonal
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // rotate 90 degrees counterclockwise
+				sx, sy = w-1-dy, dx
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(sx, sy):][:4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,238 @@
+package toolbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"testing"
+)
+
+// testJPEG encodes a 40x20 JPEG and adds an EXIF segment with the given orientation,
+// followed by a marker that stands in for metadata such as a GPS position.
+func testJPEG(t *testing.T, orientation uint16) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 6), G: 64, B: uint8(y * 12), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var exif bytes.Buffer
+	exif.WriteString("Exif\x00\x00MM\x00\x2a")
+	for _, v := range []any{
+		uint32(8),                            // offset of the first IFD
+		uint16(1),                            // one entry
+		uint16(0x0112), uint16(3), uint32(1), // orientation, SHORT, one value
+		orientation, uint16(0),
+		uint32(0), // no next IFD
+	} {
+		_ = binary.Write(&exif, binary.BigEndian, v)
+	}
+	exif.WriteString("GPS-secret")
+
+	out := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	out = binary.BigEndian.AppendUint16(out, uint16(exif.Len()+2))
+	out = append(out, exif.Bytes()...)
+	return append(out, buf.Bytes()[2:]...)
+}
+
+func TestTools_UploadFilesImageMaxPixels(t *testing.T) {
+	testTools := Tools{Storage: &MemoryStorage{}}
+	testTools.UploadedFile.Image.MaxPixels = 1000
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", data: testPNG(t)})
+	_, err := testTools.UploadFiles(req, "uploads")
+
+	var tooLarge *ImageTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected *ImageTooLargeError, got %v", err)
+	}
+	if tooLarge.Pixels != 64*48 {
+		t.Errorf("wrong pixel count. wanted=%d, got=%d", 64*48, tooLarge.Pixels)
+	}
+}
+
+// testGIF encodes an animated 20x20 GIF with the given number of frames.
+func testGIF(t *testing.T, frames int) []byte {
+	g := &gif.GIF{}
+	palette := color.Palette{color.Black, color.White}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 20, 20), palette))
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var animatedGIFTests = []struct {
+	name           string
+	frames         int
+	strip          bool
+	expectedPixels int64
+}{
+	{name: "one frame", frames: 1},
+	{name: "few frames", frames: 5, strip: true},
+	{name: "many frames", frames: 50, expectedPixels: 26 * 400},
+	{name: "many frames stripped", frames: 50, strip: true, expectedPixels: 26 * 400},
+}
+
+func TestTools_UploadFilesAnimatedGIF(t *testing.T) {
+	for _, e := range animatedGIFTests {
+		testTools := Tools{Storage: &MemoryStorage{}}
+		testTools.UploadedFile.Image.MaxPixels = 10000
+		testTools.UploadedFile.Image.StripMetadata = e.strip
+		testTools.UploadedFile.Image.Thumbnails = []ThumbnailSize{{Name: "small", Width: 10}}
+
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "anim.gif", data: testGIF(t, e.frames)})
+		_, err := testTools.UploadFiles(req, "uploads")
+
+		var tooLarge *ImageTooLargeError
+		switch {
+		case e.expectedPixels == 0 && err != nil:
+			t.Errorf("%s: %s", e.name, err)
+		case e.expectedPixels > 0 && !errors.As(err, &tooLarge):
+			t.Errorf("%s: expected *ImageTooLargeError, got %v", e.name, err)
+		case e.expectedPixels > 0 && tooLarge.Pixels != e.expectedPixels:
+			// counting stops at the first frame going over the limit
+			t.Errorf("%s: wrong pixel count. wanted=%d, got=%d", e.name, e.expectedPixels, tooLarge.Pixels)
+		}
+	}
+}
+
+var thumbnailTests = []struct {
+	name           string
+	size           ThumbnailSize
+	expectedWidth  int
+	expectedHeight int
+}{
+	{name: "box", size: ThumbnailSize{Name: "small", Width: 16, Height: 16}, expectedWidth: 16, expectedHeight: 12},
+	{name: "width only", size: ThumbnailSize{Name: "medium", Width: 32}, expectedWidth: 32, expectedHeight: 24},
+	{name: "height only", size: ThumbnailSize{Name: "tall", Height: 12}, expectedWidth: 16, expectedHeight: 12},
+	{name: "no upscaling", size: ThumbnailSize{Name: "large", Width: 640, Height: 480}, expectedWidth: 64, expectedHeight: 48},
+}
+
+func TestTools_UploadFilesThumbnails(t *testing.T) {
+	var store MemoryStorage
+	testTools := Tools{Storage: &store}
+	for _, e := range thumbnailTests {
+		testTools.UploadedFile.Image.Thumbnails = append(testTools.UploadedFile.Image.Thumbnails, e.size)
+	}
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "photo.png", data: testPNG(t)})
+	files, err := testTools.UploadFiles(req, "uploads", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files[0].Derived) != len(thumbnailTests) {
+		t.Fatalf("wrong number of derived files. wanted=%d, got=%d", len(thumbnailTests), len(files[0].Derived))
+	}
+
+	for i, e := range thumbnailTests {
+		derived := files[0].Derived[i]
+		if derived.NewFileName != "photo_"+e.size.Name+".png" {
+			t.Errorf("%s: wrong file name: %s", e.name, derived.NewFileName)
+		}
+
+		rc, err := store.Get(context.Background(), "uploads/"+derived.NewFileName)
+		if err != nil {
+			t.Fatalf("%s: expected thumbnail in storage: %s", e.name, err)
+		}
+		config, format, err := image.DecodeConfig(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+		if format != "png" || config.Width != e.expectedWidth || config.Height != e.expectedHeight {
+			t.Errorf("%s: wrong thumbnail. wanted=png %dx%d, got=%s %dx%d", e.name, e.expectedWidth, e.expectedHeight, format, config.Width, config.Height)
+		}
+		if derived.Width != config.Width || derived.Height != config.Height {
+			t.Errorf("%s: wrong recorded size: %dx%d", e.name, derived.Width, derived.Height)
+		}
+	}
+}
+
+func TestTools_UploadFilesStripMetadata(t *testing.T) {
+	var store MemoryStorage
+	testTools := Tools{Storage: &store}
+	testTools.UploadedFile.Image.StripMetadata = true
+
+	// orientation 6 means the picture has to be turned clockwise to display upright
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "photo.jpg", data: testJPEG(t, 6)})
+	files, err := testTools.UploadFiles(req, "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := store.Get(context.Background(), "uploads/"+files[0].NewFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := io.ReadAll(rc)
+	rc.Close()
+
+	if bytes.Contains(saved, []byte("Exif")) || bytes.Contains(saved, []byte("GPS-secret")) {
+		t.Error("metadata was not stripped")
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(saved))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 20 || config.Height != 40 {
+		t.Errorf("image was not rotated. wanted=20x40, got=%dx%d", config.Width, config.Height)
+	}
+
+	// the checksum and size describe what was stored, not what was sent
+	sum := sha256.Sum256(saved)
+	if files[0].Checksum != hex.EncodeToString(sum[:]) {
+		t.Error("checksum does not match the stored file")
+	}
+	if files[0].FileSize != int64(len(saved)) {
+		t.Errorf("wrong file size. wanted=%d, got=%d", len(saved), files[0].FileSize)
+	}
+}
+
+var orientTests = []struct {
+	orientation int
+	// expected is where the top-left pixel of the source ends up
+	expectedX, expectedY int
+}{
+	{orientation: 1, expectedX: 0, expectedY: 0},
+	{orientation: 2, expectedX: 2, expectedY: 0},
+	{orientation: 3, expectedX: 2, expectedY: 1},
+	{orientation: 4, expectedX: 0, expectedY: 1},
+	{orientation: 5, expectedX: 0, expectedY: 0},
+	{orientation: 6, expectedX: 1, expectedY: 0},
+	{orientation: 7, expectedX: 1, expectedY: 2},
+	{orientation: 8, expectedX: 0, expectedY: 2},
+}
+
+func TestOrient(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	src.Set(0, 0, red)
+
+	for _, e := range orientTests {
+		got := orient(src, e.orientation)
+		if got.At(e.expectedX, e.expectedY) != red {
+			t.Errorf("orientation %d: top-left pixel not found at %d,%d", e.orientation, e.expectedX, e.expectedY)
+		}
+		if jpegOrientation(testJPEG(t, uint16(e.orientation))) != e.orientation {
+			t.Errorf("orientation %d: not read back from EXIF", e.orientation)
+		}
+	}
+}
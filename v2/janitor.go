@@ -0,0 +1,420 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AccessLog records when stored files were last downloaded, so a Janitor can delete the
+// files nobody uses any more. Set it on Tools.AccessLog to have DownloadStaticFile record
+// every download. Implementations must be safe for concurrent use.
+type AccessLog interface {
+	// Touch records that key was accessed at the given time.
+	Touch(ctx context.Context, key string, at time.Time) error
+	// LastAccess returns when key was last accessed, or the zero time when it never was.
+	LastAccess(ctx context.Context, key string) (time.Time, error)
+	// Forget drops what is recorded for key, once it has been deleted.
+	Forget(ctx context.Context, key string) error
+}
+
+// touch records an access to key in Tools.AccessLog, if it is set.
+func (t *Tools) touch(ctx context.Context, key string) {
+	if t.AccessLog != nil {
+		_ = t.AccessLog.Touch(ctx, key, time.Now())
+	}
+}
+
+// MemoryAccessLog is an AccessLog kept in memory. The zero value is ready to use.
+type MemoryAccessLog struct {
+	mu       sync.Mutex
+	accessed map[string]time.Time
+}
+
+func (l *MemoryAccessLog) Touch(ctx context.Context, key string, at time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.accessed == nil {
+		l.accessed = make(map[string]time.Time)
+	}
+	if at.After(l.accessed[key]) {
+		l.accessed[key] = at
+	}
+	return nil
+}
+
+func (l *MemoryAccessLog) LastAccess(ctx context.Context, key string) (time.Time, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.accessed[key], nil
+}
+
+func (l *MemoryAccessLog) Forget(ctx context.Context, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.accessed, key)
+	return nil
+}
+
+// RetentionPolicy decides which of the files stored under Prefix a Janitor deletes. Zero
+// limits are not enforced.
+type RetentionPolicy struct {
+	// Prefix is the storage key prefix the policy applies to, such as an upload directory
+	// followed by a slash.
+	Prefix string
+	// MaxAge deletes files stored longer ago than this.
+	MaxAge time.Duration
+	// MaxIdle deletes files that have not been downloaded, or stored, for this long. Downloads
+	// are only known when Tools.AccessLog is set.
+	MaxIdle time.Duration
+	// MaxTotalSize deletes the least recently used files until those left under Prefix add
+	// up to at most this many bytes.
+	MaxTotalSize int64
+}
+
+// DeletionReason tells why a Janitor deleted a file.
+type DeletionReason int
+
+const (
+	// DeletedForAge is a file older than RetentionPolicy.MaxAge.
+	DeletedForAge DeletionReason = iota
+	// DeletedForIdle is a file unused for longer than RetentionPolicy.MaxIdle.
+	DeletedForIdle
+	// DeletedForSize is a file evicted to bring its prefix under RetentionPolicy.MaxTotalSize.
+	DeletedForSize
+	// DeletedTemporary is a temporary file or unfinished upload that was left behind.
+	DeletedTemporary
+)
+
+func (r DeletionReason) String() string {
+	switch r {
+	case DeletedForAge:
+		return "age"
+	case DeletedForIdle:
+		return "idle"
+	case DeletedForSize:
+		return "size"
+	case DeletedTemporary:
+		return "temporary"
+	}
+	return "unknown"
+}
+
+// Deletion describes a file deleted by a Janitor, or that would be in a dry run.
+type Deletion struct {
+	// Key is the storage key of the file. Temporary files outside the Storage, such as
+	// spool files and unfinished resumable uploads, are named by their path instead.
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// LastAccess is when the file was last downloaded, if known.
+	LastAccess time.Time
+	Reason     DeletionReason
+	// Err is set when the file could not be deleted.
+	Err error
+}
+
+// SweepReport lists what a single Janitor sweep deleted.
+type SweepReport struct {
+	// DryRun reports that nothing was actually deleted.
+	DryRun  bool
+	Deleted []Deletion
+	// Bytes is the combined size of the files deleted.
+	Bytes int64
+}
+
+// Janitor deletes uploads according to retention policies, on demand with Sweep or on a
+// schedule with Run. Files recorded in Tools.Catalog are deleted the way Tools.DeleteUpload
+// deletes them, so their catalog entries, derived files and quota usage go with them. The
+// catalog is listed once, at the start of each sweep.
+type Janitor struct {
+	// Tools provides the Storage files are deleted from, and the Catalog and AccessLog.
+	Tools    *Tools
+	Policies []RetentionPolicy
+	// TempMaxAge is how long temporary files are kept: files DiskStorage was still writing
+	// under the prefix of a policy, and spool files left in os.TempDir by an interrupted
+	// upload. Zero keeps them.
+	TempMaxAge time.Duration
+	// TusHandlers lists resumable upload handlers whose unfinished uploads are deleted once
+	// past their TusHandler.Expiration.
+	TusHandlers []*TusHandler
+	// DryRun makes Sweep report what it would delete without deleting anything.
+	DryRun bool
+	// OnDelete, when set, is called for every file deleted, or that failed to be deleted.
+	// It is not called in a dry run.
+	OnDelete func(Deletion)
+	// OnError, when set, is called with the error of every failed sweep made by Run.
+	OnError func(error)
+
+	// now is replaced in tests to move the clock forward
+	now func() time.Time
+}
+
+func (j *Janitor) clock() time.Time {
+	if j.now != nil {
+		return j.now()
+	}
+	return time.Now()
+}
+
+// sweep is the state of a single Janitor.Sweep.
+type sweep struct {
+	j      *Janitor
+	report *SweepReport
+	// entries holds the catalog entries by storage key
+	entries map[string][]CatalogEntry
+	// gone holds the keys deleted so far, including derived files deleted with their upload
+	gone map[string]bool
+	errs []error
+}
+
+// Sweep applies every policy once, then removes the temporary files and unfinished uploads
+// that have expired. It keeps going when a file can not be deleted, and returns the errors
+// met along the way joined together.
+func (j *Janitor) Sweep(ctx context.Context) (*SweepReport, error) {
+	s := &sweep{j: j, report: &SweepReport{DryRun: j.DryRun}, gone: make(map[string]bool)}
+
+	if j.Tools.Catalog != nil {
+		entries, err := j.Tools.Catalog.List(ctx)
+		if err != nil {
+			return s.report, err
+		}
+		s.entries = make(map[string][]CatalogEntry)
+		for _, e := range entries {
+			s.entries[e.Key] = append(s.entries[e.Key], e)
+		}
+	}
+
+	for _, p := range j.Policies {
+		if err := ctx.Err(); err != nil {
+			return s.report, err
+		}
+		if err := s.policy(ctx, p); err != nil {
+			s.errs = append(s.errs, err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return s.report, err
+	}
+	s.temporary()
+	return s.report, errors.Join(s.errs...)
+}
+
+// Run sweeps right away and then every interval, until ctx is done. It returns ctx.Err().
+func (j *Janitor) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := j.Sweep(ctx); err != nil && ctx.Err() == nil && j.OnError != nil {
+			j.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// lruFile is a stored file along with when it was last used.
+type lruFile struct {
+	FileInfo
+	lastAccess time.Time
+}
+
+func (s *sweep) policy(ctx context.Context, p RetentionPolicy) error {
+	files, err := s.j.Tools.storage().List(ctx, p.Prefix)
+	if err != nil {
+		return err
+	}
+	now := s.j.clock()
+
+	var kept []lruFile
+	for _, f := range files {
+		if s.gone[f.Key] {
+			continue
+		}
+		file := lruFile{FileInfo: f, lastAccess: f.ModTime}
+		if s.j.Tools.AccessLog != nil {
+			accessed, err := s.j.Tools.AccessLog.LastAccess(ctx, f.Key)
+			if err != nil {
+				return err
+			}
+			if accessed.After(file.lastAccess) {
+				file.lastAccess = accessed
+			}
+		}
+
+		switch {
+		case p.MaxAge > 0 && now.Sub(f.ModTime) > p.MaxAge:
+			s.delete(ctx, file, DeletedForAge, files)
+		case p.MaxIdle > 0 && now.Sub(file.lastAccess) > p.MaxIdle:
+			s.delete(ctx, file, DeletedForIdle, files)
+		default:
+			kept = append(kept, file)
+		}
+	}
+
+	if p.MaxTotalSize > 0 {
+		// the least recently used files go first
+		sort.SliceStable(kept, func(i, j int) bool { return kept[i].lastAccess.Before(kept[j].lastAccess) })
+		var total int64
+		isKept := make(map[string]bool, len(kept))
+		for _, f := range kept {
+			if !s.gone[f.Key] {
+				total += f.Size
+				isKept[f.Key] = true
+			}
+		}
+		for _, f := range kept {
+			if total <= p.MaxTotalSize {
+				break
+			}
+			if s.gone[f.Key] {
+				continue
+			}
+			// deleting a file may take its derived files with it
+			deleted := len(s.report.Deleted)
+			s.delete(ctx, f, DeletedForSize, files)
+			for _, d := range s.report.Deleted[deleted:] {
+				if isKept[d.Key] {
+					total -= d.Size
+				}
+			}
+		}
+	}
+
+	if s.j.TempMaxAge > 0 {
+		if disk, ok := asDiskStorage(s.j.Tools.storage()); ok {
+			temps, err := disk.tempFiles(p.Prefix)
+			if err != nil {
+				return err
+			}
+			for _, f := range temps {
+				if now.Sub(f.ModTime) > s.j.TempMaxAge {
+					s.record(Deletion{Key: f.Key, Size: f.Size, ModTime: f.ModTime, Reason: DeletedTemporary}, func() error {
+						return disk.Delete(ctx, f.Key)
+					})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// delete removes a stored file, along with its catalog entries when it has any, and
+// records the deletion of the file and any files derived from it. listed holds the files
+// of the policy, for the sizes of the derived files.
+func (s *sweep) delete(ctx context.Context, f lruFile, reason DeletionReason, listed []FileInfo) {
+	d := Deletion{Key: f.Key, Size: f.Size, ModTime: f.ModTime, Reason: reason}
+	if !f.lastAccess.Equal(f.ModTime) {
+		d.LastAccess = f.lastAccess
+	}
+
+	entries := s.entries[f.Key]
+	ok := s.record(d, func() error {
+		if len(entries) == 0 {
+			return s.j.Tools.storage().Delete(ctx, f.Key)
+		}
+		// every entry of the key is deleted, so the file is shared until the last one, which
+		// saves DeleteUpload from listing the whole catalog for each of them
+		for i, e := range entries {
+			shared := s.j.Tools.UploadedFile.ContentAddressed && i < len(entries)-1
+			if err := s.j.Tools.deleteUpload(ctx, &e, shared); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if !ok {
+		return
+	}
+
+	for _, e := range entries {
+		for _, key := range e.Derived {
+			if s.gone[key] {
+				continue
+			}
+			derived := Deletion{Key: key, Reason: reason}
+			for _, l := range listed {
+				if l.Key == key {
+					derived.Size, derived.ModTime = l.Size, l.ModTime
+				}
+			}
+			// already deleted by DeleteUpload
+			s.record(derived, func() error { return nil })
+		}
+	}
+	delete(s.entries, f.Key)
+}
+
+// record deletes a file with remove, unless this is a dry run, and adds it to the report.
+// It reports whether the file is gone, or would be.
+func (s *sweep) record(d Deletion, remove func() error) bool {
+	if !s.j.DryRun {
+		if err := remove(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			d.Err = err
+			s.errs = append(s.errs, err)
+		}
+		if d.Err == nil && s.j.Tools.AccessLog != nil {
+			_ = s.j.Tools.AccessLog.Forget(context.Background(), d.Key)
+		}
+		if s.j.OnDelete != nil {
+			s.j.OnDelete(d)
+		}
+	}
+	if d.Err != nil {
+		return false
+	}
+	s.gone[d.Key] = true
+	s.report.Deleted = append(s.report.Deleted, d)
+	s.report.Bytes += d.Size
+	return true
+}
+
+// temporary removes the expired spool files and unfinished resumable uploads.
+func (s *sweep) temporary() {
+	now := s.j.clock()
+
+	if s.j.TempMaxAge > 0 {
+		matches, _ := filepath.Glob(filepath.Join(os.TempDir(), spoolFilePattern))
+		for _, p := range matches {
+			info, err := os.Stat(p)
+			if err != nil || info.IsDir() || now.Sub(info.ModTime()) <= s.j.TempMaxAge {
+				continue
+			}
+			s.record(Deletion{Key: p, Size: info.Size(), ModTime: info.ModTime(), Reason: DeletedTemporary}, func() error {
+				return os.Remove(p)
+			})
+		}
+	}
+
+	for _, h := range s.j.TusHandlers {
+		expired, err := h.expiredUploads()
+		if err != nil {
+			s.errs = append(s.errs, err)
+			continue
+		}
+		for _, info := range expired {
+			d := Deletion{Key: h.dataPath(info.ID), Reason: DeletedTemporary}
+			if info.File != nil {
+				// the data of a completed upload is gone, only its state is left
+				d.Key = h.infoPath(info.ID)
+			}
+			if fi, err := os.Stat(d.Key); err == nil {
+				d.Size, d.ModTime = fi.Size(), fi.ModTime()
+			}
+			h.removeExpired(info.ID, func() {
+				s.record(d, func() error {
+					h.remove(info.ID)
+					return nil
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package toolbox
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newJanitorStorage stores files of 100 bytes under uploads/, last modified the given time ago.
+func newJanitorStorage(t *testing.T, now time.Time, ages map[string]time.Duration) DiskStorage {
+	store := DiskStorage{Root: t.TempDir()}
+	for name, age := range ages {
+		key := "uploads/" + name
+		if _, err := store.Put(context.Background(), key, bytes.NewReader(make([]byte, 100))); err != nil {
+			t.Fatal(err)
+		}
+		modTime := now.Add(-age)
+		if err := os.Chtimes(store.path(key), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+var janitorTests = []struct {
+	name     string
+	policy   RetentionPolicy
+	dryRun   bool
+	expected string
+}{
+	{name: "age", policy: RetentionPolicy{Prefix: "uploads/", MaxAge: 7 * 24 * time.Hour}, expected: "uploads/old.txt"},
+	{name: "idle", policy: RetentionPolicy{Prefix: "uploads/", MaxIdle: 2 * 24 * time.Hour}, expected: "uploads/idle.txt,uploads/old.txt"},
+	{name: "size", policy: RetentionPolicy{Prefix: "uploads/", MaxTotalSize: 250}, expected: "uploads/old.txt,uploads/idle.txt"},
+	{name: "dry run", policy: RetentionPolicy{Prefix: "uploads/", MaxAge: 7 * 24 * time.Hour}, dryRun: true, expected: "uploads/old.txt"},
+	{name: "other prefix", policy: RetentionPolicy{Prefix: "avatars/", MaxAge: time.Hour}, expected: ""},
+}
+
+func TestJanitor_Sweep(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+
+	for _, e := range janitorTests {
+		store := newJanitorStorage(t, now, map[string]time.Duration{
+			"old.txt":  10 * day,
+			"idle.txt": 3 * day,
+			"used.txt": 3 * day,
+			"new.txt":  time.Hour,
+		})
+		testTools := Tools{Storage: store, AccessLog: &MemoryAccessLog{}}
+
+		// used.txt was downloaded recently, which keeps it from being idle
+		rr := httptest.NewRecorder()
+		testTools.DownloadStaticFile(rr, httptest.NewRequest("GET", "/", nil), "uploads/used.txt", "used.txt")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("wrong status code. wanted=200, got=%d", rr.Code)
+		}
+
+		var hooked []string
+		janitor := Janitor{
+			Tools:    &testTools,
+			Policies: []RetentionPolicy{e.policy},
+			DryRun:   e.dryRun,
+			OnDelete: func(d Deletion) { hooked = append(hooked, d.Key) },
+			now:      func() time.Time { return now },
+		}
+		report, err := janitor.Sweep(context.Background())
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+
+		var deleted []string
+		for _, d := range report.Deleted {
+			deleted = append(deleted, d.Key)
+		}
+		if strings.Join(deleted, ",") != e.expected {
+			t.Errorf("%s: wrong files deleted. wanted=%s, got=%v", e.name, e.expected, deleted)
+		}
+		if report.Bytes != int64(100*len(deleted)) {
+			t.Errorf("%s: wrong bytes freed. wanted=%d, got=%d", e.name, 100*len(deleted), report.Bytes)
+		}
+
+		left, _ := store.List(context.Background(), "uploads/")
+		if e.dryRun {
+			if len(left) != 4 || len(hooked) != 0 {
+				t.Errorf("%s: dry run deleted files: %d left, %d hooked", e.name, len(left), len(hooked))
+			}
+			continue
+		}
+		if len(left) != 4-len(deleted) || len(hooked) != len(deleted) {
+			t.Errorf("%s: wrong files left: %d left, %d hooked", e.name, len(left), len(hooked))
+		}
+	}
+}
+
+func TestJanitor_SweepCatalog(t *testing.T) {
+	var catalog MemoryCatalog
+	testTools := Tools{Storage: &MemoryStorage{}, Catalog: &catalog}
+	testTools.UploadedFile.Image.Thumbnails = []ThumbnailSize{{Name: "small", Width: 16}}
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "me.png", data: testPNG(t)})
+	files, err := testTools.UploadFiles(req, "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	janitor := Janitor{
+		Tools:    &testTools,
+		Policies: []RetentionPolicy{{Prefix: "uploads/", MaxAge: time.Hour}},
+		now:      func() time.Time { return time.Now().Add(2 * time.Hour) },
+	}
+	report, err := janitor.Sweep(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Deleted) != 2 {
+		t.Errorf("wrong number of files deleted. wanted=2, got=%d", len(report.Deleted))
+	}
+	if _, err := catalog.Get(context.Background(), files[0].ID); err == nil {
+		t.Error("expected the catalog entry to be deleted along with the file")
+	}
+}
+
+// listCountingCatalog counts the calls to List.
+type listCountingCatalog struct {
+	MemoryCatalog
+	lists int
+}
+
+func (c *listCountingCatalog) List(ctx context.Context) ([]CatalogEntry, error) {
+	c.lists++
+	return c.MemoryCatalog.List(ctx)
+}
+
+func TestJanitor_SweepContentAddressed(t *testing.T) {
+	catalog := &listCountingCatalog{}
+	store := &MemoryStorage{}
+	testTools := Tools{Storage: store, Catalog: catalog}
+	testTools.UploadedFile.ContentAddressed = true
+
+	// the same file uploaded twice is stored once, under two catalog entries
+	req := newMultipartRequest(t,
+		testPart{field: "file", fileName: "a.txt", data: []byte("alpha")},
+		testPart{field: "file", fileName: "b.txt", data: []byte("bravo")},
+		testPart{field: "file", fileName: "copy.txt", data: []byte("alpha")},
+	)
+	if _, err := testTools.UploadFiles(req, "uploads"); err != nil {
+		t.Fatal(err)
+	}
+
+	janitor := Janitor{
+		Tools:    &testTools,
+		Policies: []RetentionPolicy{{Prefix: "uploads/", MaxAge: time.Hour}},
+		now:      func() time.Time { return time.Now().Add(2 * time.Hour) },
+	}
+	report, err := janitor.Sweep(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Deleted) != 2 {
+		t.Errorf("wrong number of files deleted. wanted=2, got=%d", len(report.Deleted))
+	}
+	if catalog.lists != 1 {
+		t.Errorf("wrong number of catalog listings. wanted=1, got=%d", catalog.lists)
+	}
+	if entries, _ := catalog.MemoryCatalog.List(context.Background()); len(entries) != 0 {
+		t.Errorf("wrong number of catalog entries left. wanted=0, got=%d", len(entries))
+	}
+	if left, _ := store.List(context.Background(), "uploads/"); len(left) != 0 {
+		t.Errorf("wrong number of files left. wanted=0, got=%d", len(left))
+	}
+}
+
+func TestJanitor_SweepTemporary(t *testing.T) {
+	now := time.Now()
+	// spool files left by other processes must not get in the way
+	t.Setenv("TMPDIR", t.TempDir())
+	store := newJanitorStorage(t, now, map[string]time.Duration{"kept.txt": time.Hour})
+
+	// a write interrupted two days ago
+	tmp := filepath.Join(store.Root, "uploads", ".toolbox-123.tmp")
+	if err := os.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := now.Add(-48 * time.Hour)
+	_ = os.Chtimes(tmp, old, old)
+
+	// an unfinished resumable upload past its expiration
+	h := &TusHandler{
+		Tools:      &Tools{Storage: &MemoryStorage{}},
+		BasePath:   "/files/",
+		PartialDir: t.TempDir(),
+		Expiration: time.Hour,
+		now:        func() time.Time { return now.Add(-2 * time.Hour) },
+	}
+	srv := newTusServer(t, h)
+	tusRequest(t, http.MethodPost, srv.URL+"/files/", map[string]string{"Upload-Length": "10"}, nil)
+	h.now = func() time.Time { return now }
+
+	janitor := Janitor{
+		// set as a pointer, which must not hide the temporary files
+		Tools:       &Tools{Storage: &store},
+		Policies:    []RetentionPolicy{{Prefix: "uploads/"}},
+		TempMaxAge:  24 * time.Hour,
+		TusHandlers: []*TusHandler{h},
+		now:         func() time.Time { return now },
+	}
+	report, err := janitor.Sweep(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	temporary := 0
+	for _, d := range report.Deleted {
+		if d.Reason == DeletedTemporary {
+			temporary++
+		}
+	}
+	if temporary != 2 || len(report.Deleted) != 2 {
+		t.Errorf("wrong files deleted: %+v", report.Deleted)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Error("expected the temporary file to be deleted")
+	}
+	if entries, _ := os.ReadDir(h.PartialDir); len(entries) != 0 {
+		t.Errorf("wrong number of partial files left. wanted=0, got=%d", len(entries))
+	}
+	if left, _ := store.List(context.Background(), "uploads/"); len(left) != 1 {
+		t.Errorf("wrong number of files left. wanted=1, got=%d", len(left))
+	}
+}
@@ -0,0 +1,211 @@
+package toolbox
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The query parameters a signed URL carries.
+const (
+	signKeyIDParam       = "key_id"
+	signExpiresParam     = "expires"
+	signMaxSizeParam     = "max_size"
+	signContentTypeParam = "content_type"
+	signSignatureParam   = "signature"
+)
+
+// URLSigner creates and checks short lived URLs that let anyone holding them make one kind of
+// request, such as a browser uploading to or downloading from a single path, without any other
+// authentication. Each URL carries an HMAC-SHA256 signature over its method, path, expiry,
+// constraints and other query parameters, made with the key named by KeyID.
+//
+// Keys are rotated by adding a new key, signing with it through KeyID, and removing the old
+// one once the URLs signed with it have expired.
+type URLSigner struct {
+	// Keys holds the secret keys by key ID. Every key that signed a URL still in use must
+	// be listed.
+	Keys map[string][]byte
+	// KeyID is the key new URLs are signed with.
+	KeyID string
+
+	// now is replaced in tests to move the clock forward
+	now func() time.Time
+}
+
+// URLConstraints limits what may be sent to a signed upload URL.
+type URLConstraints struct {
+	// MaxSize is the largest request body accepted, in bytes. Zero means no limit.
+	MaxSize int64
+	// ContentType is the only type, as detected by Tools.FileTypes, that uploaded files may
+	// have. Any type is accepted when it is empty.
+	ContentType string
+}
+
+// SignedURL describes a request verified by URLSigner.
+type SignedURL struct {
+	Method  string
+	Path    string
+	Expires time.Time
+	KeyID   string
+	URLConstraints
+}
+
+// InvalidSignatureError is returned for a URL that is not signed, has been changed since it
+// was signed, is used with another method, or was signed with an unknown key.
+type InvalidSignatureError struct {
+	Reason string
+}
+
+func (e *InvalidSignatureError) Error() string {
+	return "invalid URL signature: " + e.Reason
+}
+
+// URLExpiredError is returned for a signed URL used after it expired.
+type URLExpiredError struct {
+	Expires time.Time
+}
+
+func (e *URLExpiredError) Error() string {
+	return fmt.Sprintf("signed URL expired at %s", e.Expires.Format(time.RFC3339))
+}
+
+func (s *URLSigner) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// SignURL returns rawURL signed for requests with method until expires from now, limited by
+// the constraints, if given. The host of rawURL is not signed, so the URL stays valid behind
+// a proxy.
+func (s *URLSigner) SignURL(method, rawURL string, expires time.Duration, constraints ...URLConstraints) (string, error) {
+	key, ok := s.Keys[s.KeyID]
+	if !ok || len(key) == 0 {
+		return "", fmt.Errorf("no signing key with ID %q", s.KeyID)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	for _, p := range []string{signKeyIDParam, signExpiresParam, signMaxSizeParam, signContentTypeParam, signSignatureParam} {
+		query.Del(p)
+	}
+	query.Set(signKeyIDParam, s.KeyID)
+	query.Set(signExpiresParam, strconv.FormatInt(s.clock().Add(expires).Unix(), 10))
+	if len(constraints) > 0 {
+		if constraints[0].MaxSize > 0 {
+			query.Set(signMaxSizeParam, strconv.FormatInt(constraints[0].MaxSize, 10))
+		}
+		if constraints[0].ContentType != "" {
+			query.Set(signContentTypeParam, constraints[0].ContentType)
+		}
+	}
+
+	query.Set(signSignatureParam, signature(key, method, u.EscapedPath(), query))
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// signature returns the signature of a request with method for path and query, leaving out
+// the signature parameter itself. url.Values.Encode sorts the parameters, so their order in
+// the URL does not matter.
+func signature(key []byte, method, path string, query url.Values) string {
+	signed := url.Values{}
+	for k, v := range query {
+		if k != signSignatureParam {
+			signed[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(method + "\n" + path + "\n" + signed.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyRequest checks the signature and expiry of the URL of r, and returns what it was
+// signed for. A URL signed for GET is also valid for HEAD. It returns an
+// *InvalidSignatureError or a *URLExpiredError when the URL can not be used.
+func (s *URLSigner) VerifyRequest(r *http.Request) (*SignedURL, error) {
+	query := r.URL.Query()
+	keyID := query.Get(signKeyIDParam)
+	sig := query.Get(signSignatureParam)
+	if keyID == "" || sig == "" {
+		return nil, &InvalidSignatureError{Reason: "URL is not signed"}
+	}
+	key, ok := s.Keys[keyID]
+	if !ok || len(key) == 0 {
+		return nil, &InvalidSignatureError{Reason: fmt.Sprintf("unknown key ID %q", keyID)}
+	}
+
+	method := r.Method
+	valid := hmac.Equal([]byte(sig), []byte(signature(key, method, r.URL.EscapedPath(), query)))
+	if !valid && method == http.MethodHead {
+		method = http.MethodGet
+		valid = hmac.Equal([]byte(sig), []byte(signature(key, method, r.URL.EscapedPath(), query)))
+	}
+	if !valid {
+		return nil, &InvalidSignatureError{Reason: "signature does not match"}
+	}
+
+	// the parameters below are covered by the signature, so they are well formed unless the
+	// key itself has leaked
+	signed := &SignedURL{Method: method, Path: r.URL.Path, KeyID: keyID}
+	expires, err := strconv.ParseInt(query.Get(signExpiresParam), 10, 64)
+	if err != nil {
+		return nil, &InvalidSignatureError{Reason: "invalid expiry"}
+	}
+	signed.Expires = time.Unix(expires, 0)
+	if !s.clock().Before(signed.Expires) {
+		return nil, &URLExpiredError{Expires: signed.Expires}
+	}
+	if v := query.Get(signMaxSizeParam); v != "" {
+		if signed.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, &InvalidSignatureError{Reason: "invalid max size"}
+		}
+	}
+	signed.ContentType = query.Get(signContentTypeParam)
+	return signed, nil
+}
+
+// signedURLKey is the context key the SignedURL of a request is stored under.
+type signedURLKey struct{}
+
+// SignedURLFromContext returns the SignedURL stored by URLSigner.Middleware, if any.
+func SignedURLFromContext(ctx context.Context) (*SignedURL, bool) {
+	signed, ok := ctx.Value(signedURLKey{}).(*SignedURL)
+	return signed, ok
+}
+
+// Middleware only lets requests with a valid signed URL through to next, such as a handler
+// calling UploadFiles or DownloadStaticFile. Other requests get a 403 response, and request
+// bodies over URLConstraints.MaxSize a 413 response. The SignedURL is stored in the request
+// context, where UploadFiles enforces URLConstraints.ContentType.
+//
+// The path is checked as it is when the request reaches the middleware, so it should wrap
+// handlers such as http.StripPrefix rather than be wrapped by them.
+func (s *URLSigner) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signed, err := s.VerifyRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if signed.MaxSize > 0 {
+			if r.ContentLength > signed.MaxSize {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, signed.MaxSize)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), signedURLKey{}, signed)))
+	})
+}
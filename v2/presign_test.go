@@ -0,0 +1,174 @@
+package toolbox
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSigner(now time.Time) *URLSigner {
+	return &URLSigner{
+		Keys:  map[string][]byte{"2024-01": []byte("old secret"), "2024-06": []byte("new secret")},
+		KeyID: "2024-06",
+		now:   func() time.Time { return now },
+	}
+}
+
+var signedURLTests = []struct {
+	name          string
+	signMethod    string
+	method        string
+	change        func(signed string) string
+	later         time.Duration
+	errorExpected string
+}{
+	{name: "valid", signMethod: "PUT", method: "PUT"},
+	{name: "head for get", signMethod: "GET", method: "HEAD"},
+	{name: "other method", signMethod: "PUT", method: "POST", errorExpected: "invalid"},
+	{name: "other path", signMethod: "PUT", method: "PUT", change: func(s string) string { return strings.Replace(s, "/files/a.png", "/files/b.png", 1) }, errorExpected: "invalid"},
+	{name: "raised max size", signMethod: "PUT", method: "PUT", change: func(s string) string { return strings.Replace(s, "max_size=1024", "max_size=9999", 1) }, errorExpected: "invalid"},
+	{name: "added parameter", signMethod: "PUT", method: "PUT", change: func(s string) string { return s + "&owner=bob" }, errorExpected: "invalid"},
+	{name: "unsigned", signMethod: "PUT", method: "PUT", change: func(s string) string { return "/files/a.png" }, errorExpected: "invalid"},
+	{name: "expired", signMethod: "PUT", method: "PUT", later: 16 * time.Minute, errorExpected: "expired"},
+}
+
+func TestURLSigner(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	signer := newTestSigner(now)
+
+	for _, e := range signedURLTests {
+		signer.now = func() time.Time { return now }
+		signed, err := signer.SignURL(e.signMethod, "https://example.com/files/a.png?album=1", 15*time.Minute, URLConstraints{MaxSize: 1024, ContentType: "image/png"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.change != nil {
+			signed = e.change(signed)
+		}
+
+		signer.now = func() time.Time { return now.Add(e.later) }
+		got, err := signer.VerifyRequest(httptest.NewRequest(e.method, signed, nil))
+
+		var invalid *InvalidSignatureError
+		var expired *URLExpiredError
+		switch {
+		case e.errorExpected == "invalid" && !errors.As(err, &invalid):
+			t.Errorf("%s: expected *InvalidSignatureError, got %v", e.name, err)
+		case e.errorExpected == "expired" && !errors.As(err, &expired):
+			t.Errorf("%s: expected *URLExpiredError, got %v", e.name, err)
+		case e.errorExpected == "" && err != nil:
+			t.Errorf("%s: %s", e.name, err)
+		case e.errorExpected == "" && (got.Path != "/files/a.png" || got.MaxSize != 1024 || got.ContentType != "image/png" || !got.Expires.Equal(now.Add(15*time.Minute))):
+			t.Errorf("%s: wrong signed URL: %+v", e.name, got)
+		}
+	}
+}
+
+func TestURLSigner_KeyRotation(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	signer := newTestSigner(now)
+	signer.KeyID = "2024-01"
+	signed, err := signer.SignURL("GET", "/files/a.png", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// URLs signed with the old key keep working while it is listed
+	signer.KeyID = "2024-06"
+	if _, err := signer.VerifyRequest(httptest.NewRequest("GET", signed, nil)); err != nil {
+		t.Errorf("expected URL signed with the previous key to be valid: %s", err)
+	}
+
+	delete(signer.Keys, "2024-01")
+	var invalid *InvalidSignatureError
+	if _, err := signer.VerifyRequest(httptest.NewRequest("GET", signed, nil)); !errors.As(err, &invalid) {
+		t.Errorf("expected *InvalidSignatureError for a removed key, got %v", err)
+	}
+
+	signer.KeyID = "missing"
+	if _, err := signer.SignURL("GET", "/files/a.png", time.Hour); err == nil {
+		t.Error("expected an error signing with an unknown key")
+	}
+}
+
+var signedUploadTests = []struct {
+	name           string
+	unsigned       bool
+	constraints    URLConstraints
+	expectedStatus int
+}{
+	{name: "allowed", constraints: URLConstraints{MaxSize: 1 << 20, ContentType: "image/png"}, expectedStatus: http.StatusOK},
+	{name: "unsigned", unsigned: true, expectedStatus: http.StatusForbidden},
+	{name: "too large", constraints: URLConstraints{MaxSize: 100}, expectedStatus: http.StatusRequestEntityTooLarge},
+	{name: "wrong type", constraints: URLConstraints{ContentType: "application/pdf"}, expectedStatus: http.StatusBadRequest},
+}
+
+func TestURLSigner_Middleware(t *testing.T) {
+	signer := newTestSigner(time.Now())
+	pngData := testPNG(t)
+
+	for _, e := range signedUploadTests {
+		testTools := Tools{Storage: &MemoryStorage{}}
+		handler := signer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := testTools.UploadFiles(r, "uploads"); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+		}))
+
+		target := "/upload/avatar"
+		if !e.unsigned {
+			var err error
+			target, err = signer.SignURL("POST", target, time.Minute, e.constraints)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "me.png", data: pngData})
+		signedReq := httptest.NewRequest("POST", target, req.Body)
+		signedReq.Header = req.Header
+		signedReq.ContentLength = req.ContentLength
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, signedReq)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status code. wanted=%d, got=%d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestURLSigner_MiddlewareChunked(t *testing.T) {
+	signer := newTestSigner(time.Now())
+	target, err := signer.SignURL("POST", "/upload/avatar", time.Minute, URLConstraints{MaxSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stream := range []bool{false, true} {
+		testTools := Tools{Storage: &MemoryStorage{}}
+		testTools.UploadedFile.Stream = stream
+		var uploadErr error
+		handler := signer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, uploadErr = testTools.UploadFiles(r, "uploads")
+		}))
+
+		// without a Content-Length, the body is only cut off once MaxSize bytes have been read
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "a.txt", data: make([]byte, 5000)})
+		signedReq := httptest.NewRequest("POST", target, io.MultiReader(req.Body))
+		signedReq.Header = req.Header
+		signedReq.ContentLength = -1
+		handler.ServeHTTP(httptest.NewRecorder(), signedReq)
+
+		var tooLarge *RequestTooLargeError
+		if !errors.As(uploadErr, &tooLarge) {
+			t.Errorf("stream=%v: expected *RequestTooLargeError, got %v", stream, uploadErr)
+			continue
+		}
+		if tooLarge.Limit != 1000 {
+			t.Errorf("stream=%v: wrong limit. wanted=1000, got=%d", stream, tooLarge.Limit)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Quota limits how much each uploader may store and how fast they may upload. Uploads are
+// counted under the key returned by Tools.Uploader, such as a user ID, an API key or an IP
+// address; without Tools.Uploader, all uploads share one quota. Zero limits are not enforced.
+type Quota struct {
+	// MaxBytes is the most bytes a key may have stored.
+	MaxBytes int64
+	// MaxFiles is the most files a key may have stored.
+	MaxFiles int64
+	// RateBytes and RateFiles limit the bytes and files a key may upload within each
+	// RateWindow, such as one hour.
+	RateBytes  int64
+	RateFiles  int64
+	RateWindow time.Duration
+	// Usage keeps track of what every key has stored and uploaded. It defaults to a
+	// MemoryUsage of this Quota's own, so Tools with different quotas count separately.
+	Usage UsageStore
+
+	// memory is the MemoryUsage used when Usage is not set, created on first use
+	memory *MemoryUsage
+	// now is replaced in tests to move the clock forward
+	now func() time.Time
+}
+
+// Usage is an amount of stored or uploaded data.
+type Usage struct {
+	Bytes int64
+	Files int64
+}
+
+// UsageStore keeps the usage counted for each key. Implementations must be safe for
+// concurrent use.
+type UsageStore interface {
+	// Usage returns the usage of key.
+	Usage(ctx context.Context, key string) (Usage, error)
+	// Reserve adds n to the usage of key, unless that takes it over limit, in which case
+	// nothing is added and ok is false. Zero fields of limit are not enforced. It returns the
+	// usage before the reservation. A non-zero ttl makes the usage of key start from zero
+	// again that long after it was first reserved.
+	Reserve(ctx context.Context, key string, n, limit Usage, ttl time.Duration) (before Usage, ok bool, err error)
+	// Release subtracts n from the usage of key.
+	Release(ctx context.Context, key string, n Usage) error
+}
+
+// QuotaExceededError is returned when an upload would take its key over Quota.MaxBytes or
+// Quota.MaxFiles. Remaining is the capacity left, -1 for limits that are not set.
+type QuotaExceededError struct {
+	Key       string
+	Limit     Usage
+	Used      Usage
+	Remaining Usage
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("upload quota exceeded for %q: %d bytes and %d files remaining", e.Key, e.Remaining.Bytes, e.Remaining.Files)
+}
+
+// RateLimitError is returned when an upload would take its key over Quota.RateBytes or
+// Quota.RateFiles. RetryAfter is the time left until the current window ends.
+type RateLimitError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("upload rate limit exceeded for %q, retry after %s", e.Key, e.RetryAfter.Round(time.Second))
+}
+
+func (q *Quota) enabled() bool {
+	return q.MaxBytes > 0 || q.MaxFiles > 0 || (q.RateWindow > 0 && (q.RateBytes > 0 || q.RateFiles > 0))
+}
+
+// quotaMemoryMu guards the creation of Quota.memory. It is not kept in Quota itself, so a
+// Quota can still be copied as it is configured.
+var quotaMemoryMu sync.Mutex
+
+func (q *Quota) usage() UsageStore {
+	if q.Usage != nil {
+		return q.Usage
+	}
+	quotaMemoryMu.Lock()
+	defer quotaMemoryMu.Unlock()
+	if q.memory == nil {
+		q.memory = &MemoryUsage{}
+	}
+	return q.memory
+}
+
+func (q *Quota) clock() time.Time {
+	if q.now != nil {
+		return q.now()
+	}
+	return time.Now()
+}
+
+// window returns the usage key and the end of the current rate window for key.
+func (q *Quota) window(key string) (string, time.Time) {
+	now := q.clock()
+	start := now.Truncate(q.RateWindow)
+	return "rate:" + key + ":" + strconv.FormatInt(start.Unix(), 10), start.Add(q.RateWindow)
+}
+
+func remaining(limit, used int64) int64 {
+	if limit <= 0 {
+		return -1
+	}
+	return max(limit-used, 0)
+}
+
+func (q *Quota) exceeded(key string, used Usage) *QuotaExceededError {
+	limit := Usage{Bytes: q.MaxBytes, Files: q.MaxFiles}
+	return &QuotaExceededError{
+		Key:       key,
+		Limit:     limit,
+		Used:      used,
+		Remaining: Usage{Bytes: remaining(limit.Bytes, used.Bytes), Files: remaining(limit.Files, used.Files)},
+	}
+}
+
+// quotaChunk is how many bytes are reserved at a time for a file read past its reservation,
+// such as a streamed file of unknown size.
+const quotaChunk = 1 << 20
+
+// quotaReservation is the usage reserved for a single file before it is written, grown as
+// the file is read past it.
+type quotaReservation struct {
+	q         *Quota
+	key       string
+	windowKey string
+	windowEnd time.Time
+	n         Usage
+}
+
+// checkQuota compares the declared sizes of all files in a request with the usage of key,
+// so a request that would go over the quota is rejected before any file is written.
+func (t *Tools) checkQuota(ctx context.Context, key string, n Usage) error {
+	q := &t.Quota
+	if !q.enabled() {
+		return nil
+	}
+	if q.MaxBytes > 0 || q.MaxFiles > 0 {
+		used, err := q.usage().Usage(ctx, key)
+		if err != nil {
+			return err
+		}
+		if (q.MaxBytes > 0 && used.Bytes+n.Bytes > q.MaxBytes) || (q.MaxFiles > 0 && used.Files+n.Files > q.MaxFiles) {
+			return q.exceeded(key, used)
+		}
+	}
+	if q.RateWindow > 0 && (q.RateBytes > 0 || q.RateFiles > 0) {
+		windowKey, end := q.window(key)
+		used, err := q.usage().Usage(ctx, windowKey)
+		if err != nil {
+			return err
+		}
+		if (q.RateBytes > 0 && used.Bytes+n.Bytes > q.RateBytes) || (q.RateFiles > 0 && used.Files+n.Files > q.RateFiles) {
+			return &RateLimitError{Key: key, RetryAfter: end.Sub(q.clock())}
+		}
+	}
+	return nil
+}
+
+// reserveQuota reserves the usage of a file of size bytes, -1 when unknown, for key. It
+// returns nil when no quota is set.
+func (t *Tools) reserveQuota(ctx context.Context, key string, size int64) (*quotaReservation, error) {
+	q := &t.Quota
+	if !q.enabled() {
+		return nil, nil
+	}
+	res := &quotaReservation{q: q, key: key, n: Usage{Bytes: max(size, 0), Files: 1}}
+
+	if q.MaxBytes > 0 || q.MaxFiles > 0 {
+		before, ok, err := q.usage().Reserve(ctx, key, res.n, Usage{Bytes: q.MaxBytes, Files: q.MaxFiles}, 0)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, q.exceeded(key, before)
+		}
+	}
+
+	if q.RateWindow > 0 && (q.RateBytes > 0 || q.RateFiles > 0) {
+		windowKey, end := q.window(key)
+		_, ok, err := q.usage().Reserve(ctx, windowKey, res.n, Usage{Bytes: q.RateBytes, Files: q.RateFiles}, end.Sub(q.clock()))
+		if err == nil && !ok {
+			err = &RateLimitError{Key: key, RetryAfter: end.Sub(q.clock())}
+		}
+		if err != nil {
+			res.settle(ctx, Usage{})
+			return nil, err
+		}
+		res.windowKey, res.windowEnd = windowKey, end
+	}
+	return res, nil
+}
+
+// grow extends the reservation to the read bytes of the file, so concurrent uploads of the
+// same key can not each count on the same room. It reserves quotaChunk bytes at a time, or
+// only what is needed when that is all that is left.
+func (r *quotaReservation) grow(ctx context.Context, read int64) error {
+	need := read - r.n.Bytes
+	if need <= 0 {
+		return nil
+	}
+	err := r.reserveBytes(ctx, max(need, quotaChunk))
+	var exceeded *QuotaExceededError
+	var limited *RateLimitError
+	if need < quotaChunk && (errors.As(err, &exceeded) || errors.As(err, &limited)) {
+		err = r.reserveBytes(ctx, need)
+	}
+	return err
+}
+
+// reserveBytes adds n bytes to the reservation.
+func (r *quotaReservation) reserveBytes(ctx context.Context, n int64) error {
+	q := r.q
+	add := Usage{Bytes: n}
+	if q.MaxBytes > 0 || q.MaxFiles > 0 {
+		before, ok, err := q.usage().Reserve(ctx, r.key, add, Usage{Bytes: q.MaxBytes}, 0)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return q.exceeded(r.key, before)
+		}
+	}
+	if r.windowKey != "" {
+		_, ok, err := q.usage().Reserve(ctx, r.windowKey, add, Usage{Bytes: q.RateBytes}, r.windowEnd.Sub(q.clock()))
+		if err == nil && !ok {
+			err = &RateLimitError{Key: r.key, RetryAfter: r.windowEnd.Sub(q.clock())}
+		}
+		if err != nil {
+			if q.MaxBytes > 0 || q.MaxFiles > 0 {
+				_ = q.usage().Release(context.WithoutCancel(ctx), r.key, add)
+			}
+			return err
+		}
+	}
+	r.n.Bytes += n
+	return nil
+}
+
+// settle replaces the reserved usage with what was actually stored, nothing when the
+// file failed.
+func (r *quotaReservation) settle(ctx context.Context, actual Usage) {
+	if r == nil || actual == r.n {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	diff := Usage{Bytes: r.n.Bytes - actual.Bytes, Files: r.n.Files - actual.Files}
+	if r.q.MaxBytes > 0 || r.q.MaxFiles > 0 {
+		_ = r.q.usage().Release(ctx, r.key, diff)
+	}
+	if r.windowKey != "" {
+		// a failed upload still counts as an attempt, but not its bytes
+		_ = r.q.usage().Release(ctx, r.windowKey, Usage{Bytes: diff.Bytes})
+	}
+}
+
+// MemoryUsage is a UsageStore kept in memory. The zero value is ready to use.
+type MemoryUsage struct {
+	mu        sync.Mutex
+	usage     map[string]*usageEntry
+	lastSweep time.Time
+}
+
+type usageEntry struct {
+	Usage
+	expires time.Time
+}
+
+// entry returns the usage of key, treating expired usage as zero. m.mu must be held.
+func (m *MemoryUsage) entry(key string, now time.Time) *usageEntry {
+	e, ok := m.usage[key]
+	if ok && !e.expires.IsZero() && !now.Before(e.expires) {
+		delete(m.usage, key)
+		ok = false
+	}
+	if !ok {
+		return &usageEntry{}
+	}
+	return e
+}
+
+func (m *MemoryUsage) Usage(ctx context.Context, key string) (Usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entry(key, time.Now()).Usage, nil
+}
+
+func (m *MemoryUsage) Reserve(ctx context.Context, key string, n, limit Usage, ttl time.Duration) (Usage, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if m.usage == nil {
+		m.usage = make(map[string]*usageEntry)
+	}
+
+	// rate windows leave expired keys behind, so clear them out now and then
+	if now.Sub(m.lastSweep) > time.Minute {
+		for k := range m.usage {
+			m.entry(k, now)
+		}
+		m.lastSweep = now
+	}
+
+	e := m.entry(key, now)
+	before := e.Usage
+	if (limit.Bytes > 0 && before.Bytes+n.Bytes > limit.Bytes) || (limit.Files > 0 && before.Files+n.Files > limit.Files) {
+		return before, false, nil
+	}
+	e.Bytes += n.Bytes
+	e.Files += n.Files
+	if e.expires.IsZero() && ttl != 0 {
+		e.expires = now.Add(ttl)
+	}
+	m.usage[key] = e
+	return before, true, nil
+}
+
+func (m *MemoryUsage) Release(ctx context.Context, key string, n Usage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.usage[key]
+	if !ok {
+		return nil
+	}
+	e.Bytes = max(e.Bytes-n.Bytes, 0)
+	e.Files = max(e.Files-n.Files, 0)
+	return nil
+}
@@ -0,0 +1,224 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newQuotaTools returns Tools counting uploads under the X-User header of each request.
+func newQuotaTools(quota Quota) *Tools {
+	if quota.Usage == nil {
+		quota.Usage = &MemoryUsage{}
+	}
+	return &Tools{
+		Storage:  &MemoryStorage{},
+		Uploader: func(r *http.Request) string { return r.Header.Get("X-User") },
+		Quota:    quota,
+	}
+}
+
+func uploadAs(t *testing.T, testTools *Tools, user string, data []byte) error {
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", data: data})
+	req.Header.Set("X-User", user)
+	_, err := testTools.UploadFiles(req, "uploads/"+user)
+	return err
+}
+
+var quotaTests = []struct {
+	name   string
+	stream bool
+}{
+	{name: "parsed", stream: false},
+	{name: "streamed", stream: true},
+}
+
+func TestTools_UploadFilesQuota(t *testing.T) {
+	pngData := testPNG(t)
+	size := int64(len(pngData))
+
+	for _, e := range quotaTests {
+		testTools := newQuotaTools(Quota{MaxBytes: 2*size + 10})
+		testTools.UploadedFile.Stream = e.stream
+
+		for i := 0; i < 2; i++ {
+			if err := uploadAs(t, testTools, "alice", pngData); err != nil {
+				t.Fatalf("%s: upload %d: %s", e.name, i, err)
+			}
+		}
+
+		err := uploadAs(t, testTools, "alice", pngData)
+		var exceeded *QuotaExceededError
+		if !errors.As(err, &exceeded) {
+			t.Fatalf("%s: expected *QuotaExceededError, got %v", e.name, err)
+		}
+		if exceeded.Key != "alice" || exceeded.Remaining.Bytes != 10 || exceeded.Remaining.Files != -1 {
+			t.Errorf("%s: wrong error: %+v", e.name, exceeded)
+		}
+
+		// the rejected file is neither stored nor counted
+		list, _ := testTools.Storage.List(context.Background(), "uploads/alice/")
+		if len(list) != 2 {
+			t.Errorf("%s: wrong number of files stored. wanted=2, got=%d", e.name, len(list))
+		}
+		used, _ := testTools.Quota.Usage.Usage(context.Background(), "alice")
+		if used != (Usage{Bytes: 2 * size, Files: 2}) {
+			t.Errorf("%s: wrong usage: %+v", e.name, used)
+		}
+
+		// other users have their own quota
+		if err := uploadAs(t, testTools, "bob", pngData); err != nil {
+			t.Errorf("%s: upload by another user: %s", e.name, err)
+		}
+	}
+}
+
+func TestTools_UploadFilesQuotaStreamedConcurrently(t *testing.T) {
+	pngData := testPNG(t)
+	size := int64(len(pngData))
+	// room for one file and a half: only one of the uploads below may be stored
+	testTools := newQuotaTools(Quota{MaxBytes: size + size/2})
+	testTools.UploadedFile.Stream = true
+	testTools.UploadedFile.MaxFileSize = 1 << 20
+	// a slow scanner keeps every upload going until all of them have been read
+	testTools.Scanner = scanFunc(func(ctx context.Context, fileName string, r io.Reader) error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored := 0
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := uploadAs(t, testTools, "alice", pngData)
+			var exceeded *QuotaExceededError
+			switch {
+			case err == nil:
+				mu.Lock()
+				stored++
+				mu.Unlock()
+			case !errors.As(err, &exceeded):
+				t.Errorf("expected *QuotaExceededError, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if stored != 1 {
+		t.Errorf("wrong number of uploads stored. wanted=1, got=%d", stored)
+	}
+	used, _ := testTools.Quota.Usage.Usage(context.Background(), "alice")
+	if used != (Usage{Bytes: size, Files: 1}) {
+		t.Errorf("wrong usage: %+v", used)
+	}
+}
+
+func TestTools_UploadFilesQuotaFiles(t *testing.T) {
+	testTools := newQuotaTools(Quota{MaxFiles: 1})
+	pngData := testPNG(t)
+
+	if err := uploadAs(t, testTools, "alice", pngData); err != nil {
+		t.Fatal(err)
+	}
+	err := uploadAs(t, testTools, "alice", pngData)
+	var exceeded *QuotaExceededError
+	if !errors.As(err, &exceeded) || exceeded.Remaining.Files != 0 {
+		t.Errorf("expected *QuotaExceededError with no files remaining, got %v", err)
+	}
+}
+
+func TestTools_UploadFilesQuotaPerTools(t *testing.T) {
+	pngData := testPNG(t)
+	// without a UsageStore of their own, each Tools counts its uploads separately
+	avatars := &Tools{Storage: &MemoryStorage{}, Quota: Quota{MaxFiles: 1}}
+	documents := &Tools{Storage: &MemoryStorage{}, Quota: Quota{MaxFiles: 1}}
+
+	if err := uploadAs(t, avatars, "alice", pngData); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadAs(t, documents, "alice", pngData); err != nil {
+		t.Errorf("expected a separate quota for other Tools: %s", err)
+	}
+	var exceeded *QuotaExceededError
+	if err := uploadAs(t, avatars, "alice", pngData); !errors.As(err, &exceeded) {
+		t.Errorf("expected *QuotaExceededError, got %v", err)
+	}
+}
+
+func TestTools_UploadFilesRateLimit(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)
+	testTools := newQuotaTools(Quota{RateFiles: 2, RateWindow: time.Hour})
+	testTools.Quota.now = func() time.Time { return now }
+	pngData := testPNG(t)
+
+	for i := 0; i < 2; i++ {
+		if err := uploadAs(t, testTools, "alice", pngData); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := uploadAs(t, testTools, "alice", pngData)
+	var limited *RateLimitError
+	if !errors.As(err, &limited) {
+		t.Fatalf("expected *RateLimitError, got %v", err)
+	}
+	if limited.RetryAfter != 45*time.Minute {
+		t.Errorf("wrong retry after. wanted=45m, got=%s", limited.RetryAfter)
+	}
+
+	now = now.Add(time.Hour)
+	if err := uploadAs(t, testTools, "alice", pngData); err != nil {
+		t.Errorf("expected upload in the next window to pass: %s", err)
+	}
+}
+
+func TestTools_DeleteUploadReleasesQuota(t *testing.T) {
+	testTools := newQuotaTools(Quota{MaxFiles: 1})
+	testTools.Catalog = &MemoryCatalog{}
+	pngData := testPNG(t)
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", data: pngData})
+	req.Header.Set("X-User", "alice")
+	files, err := testTools.UploadFiles(req, "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testTools.DeleteUpload(context.Background(), files[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadAs(t, testTools, "alice", pngData); err != nil {
+		t.Errorf("expected quota to be released by the delete: %s", err)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	ctx := context.Background()
+	var m MemoryUsage
+	limit := Usage{Bytes: 100, Files: 2}
+
+	if _, ok, _ := m.Reserve(ctx, "k", Usage{Bytes: 60, Files: 1}, limit, 0); !ok {
+		t.Fatal("expected first reservation to pass")
+	}
+	before, ok, _ := m.Reserve(ctx, "k", Usage{Bytes: 60, Files: 1}, limit, 0)
+	if ok || before != (Usage{Bytes: 60, Files: 1}) {
+		t.Errorf("expected reservation over the limit to fail, got ok=%t before=%+v", ok, before)
+	}
+
+	_ = m.Release(ctx, "k", Usage{Bytes: 60, Files: 1})
+	if used, _ := m.Usage(ctx, "k"); used != (Usage{}) {
+		t.Errorf("wrong usage after release: %+v", used)
+	}
+
+	// expired usage starts from zero again
+	_, _, _ = m.Reserve(ctx, "w", Usage{Bytes: 100, Files: 2}, limit, -time.Second)
+	if used, _ := m.Usage(ctx, "w"); used != (Usage{}) {
+		t.Errorf("wrong usage after expiry: %+v", used)
+	}
+}
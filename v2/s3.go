@@ -0,0 +1,354 @@
+package toolbox
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Storage stores files in a bucket of an S3 compatible object store, such as AWS S3 or
+// MinIO. Requests use path style addressing (Endpoint/Bucket/key) and are signed with
+// AWS Signature Version 4.
+type S3Storage struct {
+	// Endpoint is the base URL of the service, for example "https://s3.us-east-1.amazonaws.com"
+	// or "http://localhost:9000".
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Client is used to send requests. http.DefaultClient is used when it is nil.
+	Client *http.Client
+
+	// now is replaced in tests to get stable signatures
+	now func() time.Time
+}
+
+// s3Error is the XML error document returned by S3 compatible services.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Put uploads r as the object key. The request needs a known length, so when r is not a
+// file or another sized reader it is first spooled to a temporary file.
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	size, body, cleanup, err := sizedBody(r)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+
+	res, err := s.do(req, "UNSIGNED-PAYLOAD")
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return size, nil
+}
+
+// Create uploads an empty object key with If-None-Match, so the service refuses it when the
+// object already exists.
+func (s *S3Storage) Create(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("If-None-Match", "*")
+
+	res, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Get downloads the object key. The returned body is not seekable.
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Stat returns the size and last modified time of the object key.
+func (s *S3Storage) Stat(ctx context.Context, key string) (*FileInfo, error) {
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	info := &FileInfo{Key: key, Size: res.ContentLength}
+	if lm := res.Header.Get("Last-Modified"); lm != "" {
+		info.ModTime, _ = http.ParseTime(lm)
+	}
+	return info, nil
+}
+
+// Delete removes the object key.
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// List returns every object whose key starts with prefix, following continuation tokens
+// until the listing is complete.
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	var files []FileInfo
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s3Key(prefix))
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := s.do(req, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				LastModified time.Time `xml:"LastModified"`
+				Size         int64     `xml:"Size"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			files = append(files, FileInfo{Key: c.Key, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+	return files, nil
+}
+
+// s3Key strips the leading slash and "./" a file path style key may have.
+func s3Key(key string) string {
+	key = strings.TrimPrefix(key, "./")
+	return strings.TrimLeft(key, "/")
+}
+
+// newRequest builds a request for key in the bucket. An empty key addresses the bucket itself.
+func (s *S3Storage) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u, err := url.Parse(strings.TrimRight(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + s3Key(key)
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+// do signs and sends req. A 404 is turned into an error wrapping fs.ErrNotExist, a failed
+// If-None-Match into one wrapping fs.ErrExist, and any other status outside of 2xx into an
+// error carrying the code and message sent by the service.
+func (s *S3Storage) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	s.sign(req, payloadHash, now().UTC())
+
+	client := http.DefaultClient
+	if s.Client != nil {
+		client = s.Client
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, &fs.PathError{Op: strings.ToLower(req.Method), Path: req.URL.Path, Err: fs.ErrNotExist}
+	}
+	if res.StatusCode == http.StatusPreconditionFailed && req.Header.Get("If-None-Match") == "*" {
+		return nil, &fs.PathError{Op: strings.ToLower(req.Method), Path: req.URL.Path, Err: fs.ErrExist}
+	}
+	var e s3Error
+	_ = xml.NewDecoder(res.Body).Decode(&e)
+	if e.Code == "" {
+		e.Code = res.Status
+	}
+	return nil, fmt.Errorf("s3: %s %s: %s %s", req.Method, req.URL.Path, e.Code, e.Message)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req. The host, any range
+// and content headers, and all x-amz-* headers are signed.
+func (s *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" || name == "content-type" || name == "content-md5" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent encodes everything except the unreserved characters, as required by SigV4.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		segments[i] = s3Escape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for k, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// sizedBody returns the length of r along with a reader to send. Readers that can report
+// their size are used as they are; anything else is copied to a temporary file first.
+// cleanup must be called once the body has been sent.
+func sizedBody(r io.Reader) (int64, io.Reader, func(), error) {
+	noop := func() {}
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len()), r, noop, nil
+	case *os.File:
+		info, err := v.Stat()
+		if err == nil && info.Mode().IsRegular() {
+			pos, err := v.Seek(0, io.SeekCurrent)
+			if err == nil {
+				return info.Size() - pos, r, noop, nil
+			}
+		}
+	}
+
+	tmp, size, err := spoolFile(r)
+	if err != nil {
+		return 0, nil, noop, err
+	}
+	return size, tmp, func() { removeSpool(tmp) }, nil
+}
@@ -0,0 +1,188 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxFileNameLength is the longest file name, in bytes, SanitizeFilename returns. Most file
+// systems do not allow names longer than 255 bytes.
+const maxFileNameLength = 255
+
+// windowsReservedNames can not be used as a file name on Windows, with or without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFilename turns an untrusted file name into one that is safe to save on any common
+// file system. Directory components are dropped, the name is brought to Unicode NFC, control
+// and formatting characters (such as right-to-left overrides) are removed, and anything other
+// than letters, digits, marks, spaces and ._-()[]+ is replaced with an underscore. Leading and
+// trailing dots and spaces are trimmed, Windows reserved names such as CON or LPT1 are
+// prefixed with an underscore, and the name is shortened to 255 bytes, keeping its extension.
+// An error is returned when nothing usable is left.
+func (t *Tools) SanitizeFilename(name string) (string, error) {
+	// drop any directory, whichever separator it uses
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = norm.NFC.String(strings.ToValidUTF8(name, ""))
+
+	var b strings.Builder
+	lastUnderscore := false
+	for _, r := range name {
+		switch {
+		case unicode.IsControl(r) || unicode.Is(unicode.Cf, r):
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) || strings.ContainsRune(" .-()[]+", r):
+			b.WriteRune(r)
+			lastUnderscore = false
+		default:
+			// collapse runs of replaced characters into a single underscore
+			if !lastUnderscore {
+				b.WriteRune('_')
+			}
+			lastUnderscore = true
+		}
+	}
+	name = strings.Trim(b.String(), ". ")
+
+	if name == "" || strings.Trim(name, "_") == "" {
+		return "", errors.New("file name is empty after sanitizing")
+	}
+
+	stem, _, _ := strings.Cut(name, ".")
+	if windowsReservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		name = "_" + name
+	}
+
+	if len(name) > maxFileNameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > maxFileNameLength/2 {
+			ext = ""
+		}
+		base := name[:maxFileNameLength-len(ext)]
+		// do not cut a multi-byte character in half
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+		name = strings.TrimRight(base, ". ") + ext
+	}
+	return name, nil
+}
+
+// CollisionPolicy decides what UploadFiles does when a file with the same name already
+// exists in the upload directory.
+type CollisionPolicy int
+
+const (
+	// CollisionOverwrite replaces the existing file. This is the default.
+	CollisionOverwrite CollisionPolicy = iota
+	// CollisionSuffix keeps the existing file and saves the new one with a numbered suffix,
+	// such as file-1.txt.
+	CollisionSuffix
+	// CollisionError rejects the new file with a *FileExistsError.
+	CollisionError
+)
+
+// maxCollisionSuffix is the highest suffix tried by CollisionSuffix before giving up.
+const maxCollisionSuffix = 1000
+
+// FileExistsError is returned when an uploaded file would replace an existing one and
+// UploadedFile.OnCollision is CollisionError.
+type FileExistsError struct {
+	FileName string
+}
+
+func (e *FileExistsError) Error() string {
+	return fmt.Sprintf("file %q already exists", e.FileName)
+}
+
+// confinedKey joins dir and name into a storage key and makes sure the result is still
+// inside dir.
+func confinedKey(dir, name string) (string, error) {
+	base := path.Clean(filepath.ToSlash(dir))
+	key := path.Join(base, filepath.ToSlash(name))
+
+	inside := false
+	switch base {
+	case ".":
+		inside = key != ".." && !strings.HasPrefix(key, "../") && !path.IsAbs(key)
+	case "/":
+		inside = key != "/"
+	default:
+		inside = strings.HasPrefix(key, base+"/")
+	}
+	if !inside {
+		return "", fmt.Errorf("file name %q escapes the upload directory", name)
+	}
+	return key, nil
+}
+
+// resolveCollision applies UploadedFile.OnCollision to name in uploadDir and returns the
+// name the file should be saved as. The name is reserved in state, so a file of the same
+// upload saved at the same time can not take it too. With an ExclusiveStorage, the name is
+// also claimed in storage, which claimed reports; the caller must delete the empty file
+// left there when it does not go on to write the file.
+func (t *Tools) resolveCollision(ctx context.Context, state *uploadState, uploadDir, name string) (resolved string, claimed bool, err error) {
+	policy := t.UploadedFile.OnCollision
+	if policy == CollisionOverwrite {
+		return name, false, nil
+	}
+	exclusive, claims := t.storage().(ExclusiveStorage)
+
+	exists := func(name string) (bool, error) {
+		key, err := confinedKey(uploadDir, name)
+		if err != nil {
+			return false, err
+		}
+		if !state.reserve(key) {
+			return true, nil
+		}
+		if claims {
+			err = exclusive.Create(ctx, key)
+			if errors.Is(err, fs.ErrExist) {
+				return true, nil
+			}
+			return false, err
+		}
+		_, err = t.storage().Stat(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	found, err := exists(name)
+	if err != nil || !found {
+		return name, claims && err == nil, err
+	}
+	if policy == CollisionError {
+		return "", false, &FileExistsError{FileName: name}
+	}
+
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 1; i <= maxCollisionSuffix; i++ {
+		candidate := fmt.Sprintf("%s-%d%s", stem, i, ext)
+		found, err := exists(candidate)
+		if err != nil {
+			return "", false, err
+		}
+		if !found {
+			return candidate, claims, nil
+		}
+	}
+	return "", false, &FileExistsError{FileName: name}
+}
@@ -0,0 +1,150 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var sanitizeTests = []struct {
+	name          string
+	input         string
+	expected      string
+	errorExpected bool
+}{
+	{name: "plain", input: "report.pdf", expected: "report.pdf"},
+	{name: "unix traversal", input: "../../etc/passwd", expected: "passwd"},
+	{name: "windows traversal", input: `..\..\windows\win.ini`, expected: "win.ini"},
+	{name: "control characters", input: "in\x00voi\nce\t.pdf", expected: "invoice.pdf"},
+	{name: "right to left override", input: "invoice\u202efdp.exe", expected: "invoicefdp.exe"},
+	{name: "unsafe characters", input: `a<b>c:d"e|f?g*h.txt`, expected: "a_b_c_d_e_f_g_h.txt"},
+	{name: "decomposed accents", input: "Re\u0301sume\u0301.pdf", expected: "R\u00e9sum\u00e9.pdf"},
+	{name: "decomposed kana", input: "\u304b\u3099\u3044\u3053\u304f.txt", expected: "\u304c\u3044\u3053\u304f.txt"},
+	{name: "decomposed hangul", input: "\u1112\u1161\u11ab.txt", expected: "\ud55c.txt"},
+	{name: "decomposed cyrillic", input: "\u0438\u0306.txt", expected: "\u0439.txt"},
+	{name: "decomposed greek", input: "\u03b1\u0301.txt", expected: "\u03ac.txt"},
+	{name: "reordered marks", input: "e\u0323\u0302.txt", expected: "\u1ec7.txt"},
+	{name: "reserved name", input: "CON", expected: "_CON"},
+	{name: "reserved name with extension", input: "lpt1.txt", expected: "_lpt1.txt"},
+	{name: "leading dots", input: "...hidden", expected: "hidden"},
+	{name: "trailing dots and spaces", input: "name. . ", expected: "name"},
+	{name: "only dots", input: "..", errorExpected: true},
+	{name: "empty", input: "", errorExpected: true},
+	{name: "only unsafe", input: "???", errorExpected: true},
+	{name: "too long", input: strings.Repeat("a", 300) + ".txt", expected: strings.Repeat("a", 251) + ".txt"},
+	{name: "too long multibyte", input: strings.Repeat("é", 200) + ".txt", expected: strings.Repeat("é", 125) + ".txt"},
+}
+
+func TestTools_SanitizeFilename(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range sanitizeTests {
+		got, err := testTools.SanitizeFilename(e.input)
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected but none received, got %q", e.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+		if got != e.expected {
+			t.Errorf("%s: wrong name. wanted=%q, got=%q", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestTools_UploadFilesTraversal(t *testing.T) {
+	var store MemoryStorage
+	var testTools Tools
+	testTools.Storage = &store
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: `..\..\evil.txt`, data: []byte("pwned")})
+	files, err := testTools.UploadFiles(req, "uploads", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files[0].NewFileName != "evil.txt" {
+		t.Errorf("wrong file name. wanted=evil.txt, got=%s", files[0].NewFileName)
+	}
+	list, _ := store.List(context.Background(), "")
+	if len(list) != 1 || list[0].Key != "uploads/evil.txt" {
+		t.Errorf("file stored outside of the upload directory: %v", list)
+	}
+}
+
+func TestConfinedKey(t *testing.T) {
+	confinedTests := []struct {
+		dir, name string
+		expected  string
+	}{
+		{dir: "uploads", name: "a.txt", expected: "uploads/a.txt"},
+		{dir: "./uploads/", name: "sub/a.txt", expected: "uploads/sub/a.txt"},
+		{dir: ".", name: "a.txt", expected: "a.txt"},
+		{dir: "uploads", name: "../a.txt"},
+		{dir: ".", name: "../a.txt"},
+		{dir: "/srv/uploads", name: "../../etc/passwd"},
+	}
+
+	for _, e := range confinedTests {
+		key, err := confinedKey(e.dir, e.name)
+		if e.expected == "" {
+			if err == nil {
+				t.Errorf("%s + %s: expected an error, got %s", e.dir, e.name, key)
+			}
+			continue
+		}
+		if key != e.expected {
+			t.Errorf("%s + %s: wrong key. wanted=%s, got=%s (%v)", e.dir, e.name, e.expected, key, err)
+		}
+	}
+}
+
+func TestTools_UploadFilesCollision(t *testing.T) {
+	collisionTests := []struct {
+		name          string
+		policy        CollisionPolicy
+		expected      []string
+		errorExpected bool
+	}{
+		{name: "overwrite", policy: CollisionOverwrite, expected: []string{"a.txt", "a.txt", "a.txt"}},
+		{name: "suffix", policy: CollisionSuffix, expected: []string{"a.txt", "a-1.txt", "a-2.txt"}},
+		{name: "error", policy: CollisionError, errorExpected: true},
+	}
+
+	for _, e := range collisionTests {
+		var testTools Tools
+		testTools.Storage = &MemoryStorage{}
+		testTools.UploadedFile.OnCollision = e.policy
+
+		var names []string
+		var err error
+		for i := 0; i < 3; i++ {
+			req := newMultipartRequest(t, testPart{field: "file", fileName: "a.txt", data: []byte("hello")})
+			var files []*UploadedFile
+			files, err = testTools.UploadFiles(req, "uploads", false)
+			if err != nil {
+				break
+			}
+			names = append(names, files[0].NewFileName)
+		}
+
+		if e.errorExpected {
+			var exists *FileExistsError
+			if !errors.As(err, &exists) {
+				t.Errorf("%s: expected *FileExistsError, got %v", e.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+		if strings.Join(names, ",") != strings.Join(e.expected, ",") {
+			t.Errorf("%s: wrong names. wanted=%v, got=%v", e.name, e.expected, names)
+		}
+	}
+}
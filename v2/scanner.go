@@ -0,0 +1,180 @@
+package toolbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Scanner checks the content of an uploaded file before it is stored. Scan reads r in full
+// and returns an *InfectedFileError when the file must be rejected. Any other error means the
+// file could not be scanned, and the upload fails as well.
+type Scanner interface {
+	Scan(ctx context.Context, fileName string, r io.Reader) error
+}
+
+// InfectedFileError is returned when a Scanner rejects an uploaded file. Threat names what the
+// scanner found, such as a virus signature or the policy the file violates.
+type InfectedFileError struct {
+	FileName string
+	Threat   string
+}
+
+func (e *InfectedFileError) Error() string {
+	return fmt.Sprintf("uploaded file %q was rejected by the scanner: %s", e.FileName, e.Threat)
+}
+
+// scan passes the spooled file f to Tools.Scanner and rewinds it for storing.
+func (t *Tools) scan(ctx context.Context, fileName string, f io.ReadSeeker) error {
+	err := t.Scanner.Scan(ctx, fileName, f)
+	if err != nil {
+		var infected *InfectedFileError
+		if errors.As(err, &infected) {
+			return err
+		}
+		return fmt.Errorf("unable to scan %q: %w", fileName, err)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+// ClamdScanner is a Scanner that sends files to a ClamAV daemon using the INSTREAM command.
+// The daemon's StreamMaxLength setting must be at least as large as the files scanned,
+// otherwise they are refused with an error.
+type ClamdScanner struct {
+	// Network and Address locate clamd, such as "tcp" and "localhost:3310", or "unix" and
+	// "/var/run/clamav/clamd.ctl".
+	Network string
+	Address string
+	// Timeout limits how long a single scan may take. It defaults to one minute.
+	Timeout time.Duration
+	// ChunkSize is the size of the chunks the file is sent in. It defaults to 64 KiB.
+	ChunkSize int
+}
+
+func (c *ClamdScanner) dial(ctx context.Context) (net.Conn, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	network := c.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, c.Address)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// Scan streams r to clamd and returns an *InfectedFileError when clamd finds something.
+func (c *ClamdScanner) Scan(ctx context.Context, fileName string, r io.Reader) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// cut the connection short when the request is cancelled
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 64 * 1024
+	}
+
+	w := bufio.NewWriterSize(conn, chunkSize+4)
+	writeErr := func() error {
+		if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+			return err
+		}
+		chunk := make([]byte, chunkSize)
+		for {
+			n, err := io.ReadFull(r, chunk)
+			if n > 0 {
+				if err := binary.Write(w, binary.BigEndian, uint32(n)); err != nil {
+					return err
+				}
+				if _, err := w.Write(chunk[:n]); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// a zero length chunk ends the stream
+		if err := binary.Write(w, binary.BigEndian, uint32(0)); err != nil {
+			return err
+		}
+		return w.Flush()
+	}()
+
+	// clamd may answer and hang up before the whole file was sent, for instance when it
+	// goes over StreamMaxLength, so its reply is read even when writing failed
+	reply, readErr := bufio.NewReader(conn).ReadString(0)
+	if readErr != nil && reply == "" {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+		return readErr
+	}
+	return parseClamdReply(fileName, reply)
+}
+
+// Ping checks that clamd is reachable and answering.
+func (c *ClamdScanner) Ping(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return err
+	}
+	if reply = strings.TrimRight(reply, "\x00\n"); reply != "PONG" {
+		return fmt.Errorf("clamd: unexpected reply %q", reply)
+	}
+	return nil
+}
+
+// parseClamdReply turns a reply such as "stream: OK" or "stream: Eicar-Signature FOUND"
+// into an error.
+func parseClamdReply(fileName, reply string) error {
+	reply = strings.TrimRight(reply, "\x00\n")
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return nil
+	case strings.HasSuffix(result, " FOUND"):
+		return &InfectedFileError{FileName: fileName, Threat: strings.TrimSuffix(result, " FOUND")}
+	case strings.HasSuffix(result, " ERROR"):
+		return fmt.Errorf("clamd: %s", strings.TrimSuffix(result, " ERROR"))
+	}
+	return fmt.Errorf("clamd: unexpected reply %q", reply)
+}
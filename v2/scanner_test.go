@@ -0,0 +1,148 @@
+package toolbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// eicar stands in for the EICAR test signature in the fake clamd.
+const eicar = "EICAR-STANDARD-ANTIVIRUS-TEST-FILE"
+
+// newFakeClamd starts a TCP server speaking enough of the clamd protocol for the tests:
+// PING, and INSTREAM reporting any stream containing eicar as infected.
+func newFakeClamd(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				command, err := r.ReadString(0)
+				if err != nil {
+					return
+				}
+				switch command {
+				case "zPING\x00":
+					conn.Write([]byte("PONG\x00"))
+				case "zINSTREAM\x00":
+					var data bytes.Buffer
+					for {
+						var size uint32
+						if binary.Read(r, binary.BigEndian, &size) != nil {
+							return
+						}
+						if size == 0 {
+							break
+						}
+						if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+							return
+						}
+					}
+					if bytes.Contains(data.Bytes(), []byte(eicar)) {
+						conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+					} else {
+						conn.Write([]byte("stream: OK\x00"))
+					}
+				default:
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+				}
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+var clamdTests = []struct {
+	name           string
+	data           string
+	expectedThreat string
+}{
+	{name: "clean", data: "just some text"},
+	{name: "empty", data: ""},
+	{name: "infected", data: "X5O!P%@AP" + eicar, expectedThreat: "Eicar-Signature"},
+	// the signature straddles two chunks
+	{name: "infected across chunks", data: strings.Repeat("a", 10) + eicar, expectedThreat: "Eicar-Signature"},
+}
+
+func TestClamdScanner(t *testing.T) {
+	scanner := &ClamdScanner{Address: newFakeClamd(t), ChunkSize: 16}
+
+	if err := scanner.Ping(context.Background()); err != nil {
+		t.Fatalf("ping: %s", err)
+	}
+
+	for _, e := range clamdTests {
+		err := scanner.Scan(context.Background(), "file.txt", strings.NewReader(e.data))
+		var infected *InfectedFileError
+		switch {
+		case e.expectedThreat == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		case e.expectedThreat != "" && !errors.As(err, &infected):
+			t.Errorf("%s: expected *InfectedFileError, got %v", e.name, err)
+		case e.expectedThreat != "" && infected.Threat != e.expectedThreat:
+			t.Errorf("%s: wrong threat. wanted=%s, got=%s", e.name, e.expectedThreat, infected.Threat)
+		}
+	}
+}
+
+func TestTools_UploadFilesScanner(t *testing.T) {
+	pngData := testPNG(t)
+	addr := newFakeClamd(t)
+
+	// close a listener straight away to get an address nothing answers on
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	downAddr := l.Addr().String()
+	l.Close()
+
+	scannerTests := []struct {
+		name          string
+		address       string
+		data          []byte
+		errorExpected bool
+		infected      bool
+	}{
+		{name: "clean", address: addr, data: pngData},
+		{name: "infected", address: addr, data: append(append([]byte{}, pngData...), eicar...), errorExpected: true, infected: true},
+		{name: "scanner down", address: downAddr, data: pngData, errorExpected: true},
+	}
+
+	for _, e := range scannerTests {
+		var store MemoryStorage
+		testTools := Tools{Storage: &store, Scanner: &ClamdScanner{Address: e.address}}
+
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", data: e.data})
+		_, err := testTools.UploadFiles(req, "uploads")
+
+		if e.errorExpected != (err != nil) {
+			t.Errorf("%s: unexpected result: %v", e.name, err)
+		}
+		var infected *InfectedFileError
+		if e.infected != errors.As(err, &infected) {
+			t.Errorf("%s: wrong error type: %v", e.name, err)
+		}
+
+		list, _ := store.List(context.Background(), "uploads/")
+		if e.errorExpected && len(list) != 0 {
+			t.Errorf("%s: rejected file was stored", e.name)
+		}
+		if !e.errorExpected && len(list) != 1 {
+			t.Errorf("%s: wrong number of files stored. wanted=1, got=%d", e.name, len(list))
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package toolbox
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage is the interface used by Tools to save and serve files. Keys are slash separated
+// paths, such as "uploads/abc.png". Implementations report a missing key with an error
+// that wraps fs.ErrNotExist, so callers can test for it with errors.Is.
+type Storage interface {
+	// Put stores everything read from r under key, replacing any existing file, and
+	// returns the number of bytes written. If reading from r fails, nothing is stored.
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Get opens the file stored under key. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Stat returns information about the file stored under key.
+	Stat(ctx context.Context, key string) (*FileInfo, error)
+	// Delete removes the file stored under key.
+	Delete(ctx context.Context, key string) error
+	// List returns every file whose key starts with prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]FileInfo, error)
+}
+
+// ExclusiveStorage is a Storage that can claim a key only while nothing is stored under it.
+// When Tools.Storage implements it, CollisionSuffix and CollisionError claim the name of every
+// file before writing it, so uploads running at the same time can not replace each other's
+// files. With other storages, names are looked up with Stat, which only holds within one
+// request. DiskStorage, MemoryStorage and S3Storage implement it.
+type ExclusiveStorage interface {
+	Storage
+	// Create stores an empty file under key, which is then written with Put, or fails with
+	// an error wrapping fs.ErrExist when key is already stored.
+	Create(ctx context.Context, key string) error
+}
+
+// FileInfo describes a file held by a Storage.
+type FileInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// storage returns the Storage configured on t, falling back to the local disk so paths
+// keep working exactly as they are passed in.
+func (t *Tools) storage() Storage {
+	if t.Storage != nil {
+		return t.Storage
+	}
+	return DiskStorage{}
+}
+
+// storageKey joins a directory and a file name into a slash separated storage key.
+func storageKey(dir, name string) string {
+	return path.Join(filepath.ToSlash(dir), filepath.ToSlash(name))
+}
+
+// spoolFilePattern names the temporary files created by spoolFile.
+const spoolFilePattern = "toolbox-spool-*"
+
+// spoolFile copies r into a new temporary file and rewinds it, for when a file has to be
+// read more than once or its size has to be known before it is stored. The caller must
+// dispose of the file with removeSpool.
+func spoolFile(r io.Reader) (*os.File, int64, error) {
+	tmp, err := os.CreateTemp("", spoolFilePattern)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(tmp, r)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeSpool(tmp)
+		return nil, 0, err
+	}
+	return tmp, size, nil
+}
+
+// removeSpool closes and deletes a file created by spoolFile.
+func removeSpool(f *os.File) {
+	f.Close()
+	_ = os.Remove(f.Name())
+}
+
+// tempFilePattern names the temporary files DiskStorage writes before renaming them into
+// place. They are hidden, and left out of List.
+const tempFilePattern = ".toolbox-*.tmp"
+
+// isTempFile reports whether name is one of DiskStorage's temporary files.
+func isTempFile(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, ".toolbox-") && strings.HasSuffix(base, ".tmp")
+}
+
+// DiskStorage stores files on the local file system. Keys are resolved relative to Root;
+// when Root is empty they are used as ordinary file paths. With a Root set, keys can not
+// escape it: "../x" resolves to Root/x.
+type DiskStorage struct {
+	Root string
+}
+
+// asDiskStorage returns the DiskStorage behind s, which may be set as a value or a pointer.
+func asDiskStorage(s Storage) (DiskStorage, bool) {
+	switch disk := s.(type) {
+	case DiskStorage:
+		return disk, true
+	case *DiskStorage:
+		if disk != nil {
+			return *disk, true
+		}
+	}
+	return DiskStorage{}, false
+}
+
+func (s DiskStorage) path(key string) string {
+	if s.Root == "" {
+		return filepath.FromSlash(key)
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+// Put writes r to the file for key, creating any missing parent directories. The data is
+// written to a temporary file next to the destination, which is renamed into place only
+// once everything has been written, so a failed or interrupted Put never leaves a
+// truncated file behind.
+func (s DiskStorage) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	fpath := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fpath), tempFilePattern)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fpath)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+// Create creates an empty file for key, along with any missing parent directories, unless
+// a file already exists there.
+func (s DiskStorage) Create(ctx context.Context, key string) error {
+	fpath := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Get opens the file for key. The returned file is an *os.File, so it can be seeked.
+func (s DiskStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if _, err := s.Stat(ctx, key); err != nil {
+		return nil, err
+	}
+	return os.Open(s.path(key))
+}
+
+// Stat returns the size and modification time of the file for key. Directories are
+// reported as not existing.
+func (s DiskStorage) Stat(ctx context.Context, key string) (*FileInfo, error) {
+	info, err := os.Stat(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "stat", Path: s.path(key), Err: fs.ErrNotExist}
+	}
+	return &FileInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete removes the file for key.
+func (s DiskStorage) Delete(ctx context.Context, key string) error {
+	return os.Remove(s.path(key))
+}
+
+// List walks the directory holding prefix and returns the files whose key starts with prefix.
+func (s DiskStorage) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return s.walk(prefix, false)
+}
+
+// tempFiles lists the temporary files left under prefix by writes that never finished,
+// such as when the process was killed halfway through a Put.
+func (s DiskStorage) tempFiles(prefix string) ([]FileInfo, error) {
+	return s.walk(prefix, true)
+}
+
+// walk lists the files under prefix: the temporary ones when temp is set, the others when
+// it is not.
+func (s DiskStorage) walk(prefix string, temp bool) ([]FileInfo, error) {
+	dir := prefix
+	if !strings.HasSuffix(prefix, "/") {
+		dir = path.Dir(prefix)
+	}
+
+	var files []FileInfo
+	root := s.path(dir)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || isTempFile(p) != temp {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		key := storageKey(dir, rel)
+		if !strings.HasPrefix(key, path.Clean(prefix)) && prefix != "" {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+	return files, nil
+}
+
+// MemoryStorage keeps files in memory. It is meant for tests and small, short lived data.
+// The zero value is ready to use.
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// memoryReader lets files returned by MemoryStorage be seeked as well as closed.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error { return nil }
+
+// Put reads all of r and stores it under key.
+func (s *MemoryStorage) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		s.files = make(map[string]memoryFile)
+	}
+	s.files[key] = memoryFile{data: data, modTime: time.Now()}
+	return int64(len(data)), nil
+}
+
+// Create stores empty data under key, unless something is stored there already.
+func (s *MemoryStorage) Create(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[key]; ok {
+		return &fs.PathError{Op: "create", Path: key, Err: fs.ErrExist}
+	}
+	if s.files == nil {
+		s.files = make(map[string]memoryFile)
+	}
+	s.files[key] = memoryFile{modTime: time.Now()}
+	return nil
+}
+
+// Get returns a reader over the data stored under key.
+func (s *MemoryStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[key]
+	if !ok {
+		return nil, &fs.PathError{Op: "get", Path: key, Err: fs.ErrNotExist}
+	}
+	return memoryReader{bytes.NewReader(f.data)}, nil
+}
+
+// Stat returns the size and modification time of the data stored under key.
+func (s *MemoryStorage) Stat(ctx context.Context, key string) (*FileInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[key]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+	}
+	return &FileInfo{Key: key, Size: int64(len(f.data)), ModTime: f.modTime}, nil
+}
+
+// Delete removes the data stored under key.
+func (s *MemoryStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[key]; !ok {
+		return &fs.PathError{Op: "delete", Path: key, Err: fs.ErrNotExist}
+	}
+	delete(s.files, key)
+	return nil
+}
+
+// List returns every stored file whose key starts with prefix.
+func (s *MemoryStorage) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var files []FileInfo
+	for key, f := range s.files {
+		if strings.HasPrefix(key, prefix) {
+			files = append(files, FileInfo{Key: key, Size: int64(len(f.data)), ModTime: f.modTime})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+	return files, nil
+}
@@ -0,0 +1,233 @@
+package toolbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testStorage runs the same put, get, stat, list and delete checks against any Storage.
+func testStorage(t *testing.T, name string, store Storage) {
+	ctx := context.Background()
+	files := map[string]string{
+		"uploads/a.txt":     "alpha",
+		"uploads/b.txt":     "bravo",
+		"uploads/sub/c.txt": "charlie",
+		"other/d.txt":       "delta",
+	}
+
+	for key, data := range files {
+		n, err := store.Put(ctx, key, strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: put %s: %s", name, key, err)
+		}
+		if n != int64(len(data)) {
+			t.Errorf("%s: wrong size written for %s. wanted=%d, got=%d", name, key, len(data), n)
+		}
+	}
+
+	f, err := store.Get(ctx, "uploads/b.txt")
+	if err != nil {
+		t.Fatalf("%s: get: %s", name, err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "bravo" {
+		t.Errorf("%s: wrong content. wanted=bravo, got=%s", name, data)
+	}
+
+	info, err := store.Stat(ctx, "uploads/sub/c.txt")
+	if err != nil {
+		t.Fatalf("%s: stat: %s", name, err)
+	}
+	if info.Size != 7 {
+		t.Errorf("%s: wrong size. wanted=7, got=%d", name, info.Size)
+	}
+
+	list, err := store.List(ctx, "uploads/")
+	if err != nil {
+		t.Fatalf("%s: list: %s", name, err)
+	}
+	var keys []string
+	for _, f := range list {
+		keys = append(keys, f.Key)
+	}
+	if strings.Join(keys, ",") != "uploads/a.txt,uploads/b.txt,uploads/sub/c.txt" {
+		t.Errorf("%s: wrong listing: %v", name, keys)
+	}
+
+	if err := store.Delete(ctx, "uploads/a.txt"); err != nil {
+		t.Errorf("%s: delete: %s", name, err)
+	}
+	if _, err := store.Stat(ctx, "uploads/a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s: expected deleted file to not exist, got %v", name, err)
+	}
+	if _, err := store.Get(ctx, "missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s: expected fs.ErrNotExist for missing file, got %v", name, err)
+	}
+
+	// a failing reader must not leave anything behind
+	_, err = store.Put(ctx, "uploads/broken.txt", io.MultiReader(strings.NewReader("part"), errReader{}))
+	if err == nil {
+		t.Errorf("%s: expected error from failing reader", name)
+	}
+	if _, err := store.Stat(ctx, "uploads/broken.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s: partial file was kept after a failed put", name)
+	}
+
+	exclusive, ok := store.(ExclusiveStorage)
+	if !ok {
+		return
+	}
+	if err := exclusive.Create(ctx, "uploads/b.txt"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("%s: expected fs.ErrExist for an existing file, got %v", name, err)
+	}
+	if err := exclusive.Create(ctx, "uploads/new/e.txt"); err != nil {
+		t.Fatalf("%s: create: %s", name, err)
+	}
+	if info, err := store.Stat(ctx, "uploads/new/e.txt"); err != nil || info.Size != 0 {
+		t.Errorf("%s: expected an empty file to be created, got %v, %v", name, info, err)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestDiskStorage(t *testing.T) {
+	root := t.TempDir()
+	testStorage(t, "disk", DiskStorage{Root: root})
+
+	// the failed put in testStorage must not leave its temporary file behind either
+	entries, err := os.ReadDir(filepath.Join(root, "uploads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if isTempFile(e.Name()) {
+			t.Errorf("temporary file left behind: %s", e.Name())
+		}
+	}
+}
+
+func TestDiskStorage_Confined(t *testing.T) {
+	root := t.TempDir()
+	store := DiskStorage{Root: root}
+
+	if _, err := store.Put(context.Background(), "../../escape.txt", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(context.Background(), "escape.txt"); err != nil {
+		t.Errorf("expected key to resolve inside the root: %s", err)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, "memory", &MemoryStorage{})
+}
+
+func TestTools_UploadFilesStorage(t *testing.T) {
+	pngData := testPNG(t)
+	var store MemoryStorage
+	testTools := Tools{Storage: &store}
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", data: pngData})
+	uploadedFiles, err := testTools.UploadFiles(req, "uploads", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := store.Stat(context.Background(), "uploads/"+uploadedFiles[0].NewFileName)
+	if err != nil {
+		t.Fatalf("expected file in storage: %s", err)
+	}
+	if info.Size != int64(len(pngData)) {
+		t.Errorf("wrong size stored. wanted=%d, got=%d", len(pngData), info.Size)
+	}
+}
+
+func TestTools_DownloadStaticFileStorage(t *testing.T) {
+	var store MemoryStorage
+	_, _ = store.Put(context.Background(), "files/report.txt", bytes.NewReader([]byte("quarterly numbers")))
+	testTools := Tools{Storage: &store}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	testTools.DownloadStaticFile(rr, req, "files/report.txt", "report.txt")
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code. wanted=200, got=%d", rr.Code)
+	}
+	if rr.Body.String() != "quarterly numbers" {
+		t.Errorf("wrong body: %s", rr.Body.String())
+	}
+	if rr.Header().Get("Content-Disposition") != "attachment; filename=\"report.txt\"" {
+		t.Error("wrong content disposition")
+	}
+
+	rr = httptest.NewRecorder()
+	testTools.DownloadStaticFile(rr, req, "files/missing.txt", "missing.txt")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status code for missing file. wanted=404, got=%d", rr.Code)
+	}
+}
+
+var transactionalTests = []struct {
+	name          string
+	transactional bool
+	expectedFiles int
+}{
+	{name: "transactional", transactional: true, expectedFiles: 0},
+	{name: "not transactional", transactional: false, expectedFiles: 2},
+}
+
+func TestTools_UploadFilesTransactional(t *testing.T) {
+	pngData := testPNG(t)
+
+	for _, e := range transactionalTests {
+		for _, stream := range []bool{false, true} {
+			root := t.TempDir()
+			var testTools Tools
+			testTools.Storage = DiskStorage{Root: root}
+			testTools.UploadedFile.AllowedFileTypes = []string{"image/png"}
+			testTools.UploadedFile.Transactional = e.transactional
+			testTools.UploadedFile.Stream = stream
+
+			// the third file is rejected by its type; in streaming mode the parts are
+			// handled in order, so the first two are saved before that happens
+			req := newMultipartRequest(t,
+				testPart{field: "a", fileName: "a.png", data: pngData},
+				testPart{field: "b", fileName: "b.png", data: pngData},
+				testPart{field: "c", fileName: "c.txt", data: []byte("not an image")},
+			)
+			files, err := testTools.UploadFiles(req, "uploads")
+			if err == nil {
+				t.Errorf("%s: expected an error", e.name)
+			}
+			if e.transactional && files != nil {
+				t.Errorf("%s: expected no files to be returned", e.name)
+			}
+
+			list, err := testTools.Storage.List(context.Background(), "uploads/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stream && len(list) != e.expectedFiles {
+				t.Errorf("%s (stream): wrong number of files left. wanted=%d, got=%d", e.name, e.expectedFiles, len(list))
+			}
+			if e.transactional && len(list) != 0 {
+				t.Errorf("%s (stream=%t): files left after rollback: %v", e.name, stream, list)
+			}
+		}
+	}
+}
@@ -2,27 +2,73 @@ package toolbox
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math/big"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var randomRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ+_1234567890")
 
+// errFileTypeNotPermitted is returned when an uploaded file is not one of UploadedFile.AllowedFileTypes.
+var errFileTypeNotPermitted = errors.New("uploaded file type not permitted")
+
 // Tools is the type used to instantiate module. Any variable of this type
 // will have access to the methods with receiver *Tools.
 type Tools struct {
 	UploadedFile       UploadedFile
 	MaxJSONSize        int
 	AllowUnknownFields bool
+	// Storage is where uploaded files are saved and downloaded files are read from.
+	// When it is nil, the local disk is used and paths are taken as they are.
+	Storage Storage
+	// FileTypes is the registry used to detect the type of uploaded files. DefaultFileTypes
+	// is used when it is nil.
+	FileTypes *FileTypes
+	// OnUploadEvent, when set, is called as each uploaded file is started, written,
+	// finished or rejected. It is called from the goroutine handling the upload, so it
+	// should return quickly. With UploadedFile.Concurrency, it may be called from several
+	// goroutines at once.
+	OnUploadEvent func(UploadEvent)
+	// Scanner, when set, checks every uploaded file before it is stored, such as a
+	// ClamdScanner. Files are spooled to a temporary file while they are scanned.
+	Scanner Scanner
+	// Catalog, when set, records every saved upload under a random ID, returned in
+	// UploadedFile.ID, so it can later be found, downloaded and deleted by that ID.
+	Catalog Catalog
+	// Uploader, when set, tells who sent an upload request, such as the ID of the signed in
+	// user. It is recorded in the Catalog, and is the key uploads are counted under for Quota.
+	Uploader func(r *http.Request) string
+	// Quota limits the storage and upload rate of each uploader.
+	Quota Quota
+	// AccessLog, when set, records every download made with DownloadStaticFile, so a Janitor
+	// can delete the files that are no longer used.
+	AccessLog AccessLog
+	// DownloadRoot, when set, confines DownloadStaticFile to the files inside it: path names
+	// are taken relative to it, and any that lead outside it, through ".." or a symbolic
+	// link, get a 404 response.
+	DownloadRoot string
+	// AllowDotFiles lets DownloadStaticFile serve files and directories whose names start
+	// with a dot from inside DownloadRoot, such as .env. They get a 404 response otherwise.
+	AllowDotFiles bool
 }
 
 // RandomString generates a random string of length using characters from randomRunes
@@ -38,20 +84,132 @@ func (t *Tools) RandomString(n int) string {
 
 // UploadedFile is a struct represents saved information about an uploaded file
 type UploadedFile struct {
-	NewFileName      string
-	OrigFileName     string
-	FileSize         int64
-	MaxFileSize      int
+	// ID is the ID the file is recorded under in Tools.Catalog.
+	ID           string
+	NewFileName  string
+	OrigFileName string
+	FileSize     int64
+	// FieldName is the name of the form field the file was sent in.
+	FieldName string
+	// ContentType is the detected MIME type of the saved file.
+	ContentType string
+	// MaxFileSize is the largest size, in bytes, allowed for a single file. It defaults to 1 GiB.
+	MaxFileSize int
+	// MaxTotalSize is the largest combined size, in bytes, of all files in one request.
+	// Zero means no limit.
+	MaxTotalSize int
+	// MaxFiles is the largest number of files accepted in one request. Zero means no limit.
+	MaxFiles int
+	// AllowedFileTypes lists the MIME types accepted for upload, as detected by Tools.FileTypes.
+	// Any type is accepted when it is empty.
 	AllowedFileTypes []string
+	// ExtensionPolicy decides what happens when the extension of a file does not match its
+	// detected type: keep it, reject the file or save it with the canonical extension.
+	ExtensionPolicy ExtensionPolicy
+	// OnCollision decides what happens when a file with the same name is already stored:
+	// overwrite it, save the new file with a numbered suffix or reject it.
+	OnCollision CollisionPolicy
+	// HashAlgorithm is the digest computed over every file while it is copied, SHA-256 by
+	// default. MD5, SHA-1, SHA-256 and SHA-512 are available out of the box; others need
+	// their package to be imported.
+	HashAlgorithm crypto.Hash
+	// Checksum is the hex encoded digest of the saved file.
+	Checksum string
+	// ContentAddressed stores each file under its digest instead of its name, in sharded
+	// directories such as ab/cd/abcdef..., so identical files are only stored once.
+	ContentAddressed bool
+	// Duplicate reports that a content addressed file was already stored and has been reused.
+	Duplicate bool
+	// Transactional makes an upload all or nothing: when any file in a request fails, the
+	// files already saved from the same request are removed again. A file that replaced an
+	// existing one can not be brought back, so it is best combined with renaming or
+	// CollisionSuffix.
+	Transactional bool
+	// Stream makes UploadFiles read the request with r.MultipartReader instead of
+	// r.ParseMultipartForm, so each part is written to its destination as it arrives
+	// and nothing is buffered in memory or spooled to a temporary file first.
+	Stream bool
+	// Concurrency is how many files of a parsed form are processed at the same time, which
+	// speeds up uploads of many files that are scanned or resized. Zero or one processes them
+	// one after another. Streamed forms are always read one part at a time.
+	Concurrency int
+	// Image configures the processing of uploaded JPEG, PNG and GIF images: a pixel limit,
+	// metadata stripping and thumbnails. Images are spooled to a temporary file while
+	// they are processed.
+	Image ImageOptions
+	// Derived lists the files created from the uploaded file, such as its thumbnails.
+	Derived []DerivedFile
+	// Archive limits the archives extracted by ExtractArchive.
+	Archive ArchiveOptions
+	// AllowedFields lists the form fields files are accepted from. A file sent in any other
+	// field fails the upload with an *UnexpectedFieldError. Files are accepted from any field
+	// when it is empty.
+	AllowedFields []string
+}
+
+// maxFormMemory is how much of a multipart form ParseMultipartForm keeps in memory;
+// file parts beyond it are spooled to temporary files.
+const maxFormMemory = 32 << 20
+
+// uploadState keeps the running totals of a single UploadFiles call, so the request
+// wide limits can be enforced while each file is copied.
+type uploadState struct {
+	// mu guards the fields below while files are processed concurrently
+	mu    sync.Mutex
+	files int
+	total int64
+	// saved holds the storage keys of the files written so far, for a transactional
+	// upload to remove if a later file fails
+	saved []string
+	// cataloged holds the IDs of the files recorded in Tools.Catalog so far
+	cataloged []string
+	// uploader identifies who sent the files, as returned by Tools.Uploader
+	uploader string
+	// usage is what the files saved so far count against the quota of uploader
+	usage Usage
+	// contentType, when set, is the only file type the signed URL of the request allows
+	contentType string
+	// maxFileSize, when set, replaces UploadedFile.MaxFileSize
+	maxFileSize int64
+	// names holds the storage keys taken by files of the upload that may not be stored
+	// yet, so files with the same name do not get the same key
+	names map[string]bool
+}
+
+// reserve records key as taken by the upload. It reports false when another file of the
+// upload already has it.
+func (s *uploadState) reserve(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.names[key] {
+		return false
+	}
+	if s.names == nil {
+		s.names = make(map[string]bool)
+	}
+	s.names[key] = true
+	return true
+}
+
+// addSaved records keys as written by the upload.
+func (s *uploadState) addSaved(keys ...string) {
+	s.mu.Lock()
+	s.saved = append(s.saved, keys...)
+	s.mu.Unlock()
 }
 
 // UploadAFile is a convenience method that calls UploadFiles, only one file is uploaded
 func (t *Tools) UploadAFile(r *http.Request, uploadDir string, rename ...bool) (*UploadedFile, error) {
+	return t.UploadAFileContext(r.Context(), r, uploadDir, rename...)
+}
+
+// UploadAFileContext works like UploadAFile, and stops the upload once ctx is done.
+func (t *Tools) UploadAFileContext(ctx context.Context, r *http.Request, uploadDir string, rename ...bool) (*UploadedFile, error) {
 	renameFile := true
 	if len(rename) > 0 {
 		renameFile = rename[0]
 	}
-	files, err := t.UploadFiles(r, uploadDir, renameFile)
+	files, err := t.UploadFilesContext(ctx, r, uploadDir, renameFile)
 	if err != nil {
 		return nil, err
 	}
@@ -60,92 +218,660 @@ func (t *Tools) UploadAFile(r *http.Request, uploadDir string, rename ...bool) (
 
 // UploadFiles uploads one or more files to a specific directory and generates a renames each file to a random filename.
 // The function returns a slice of newly named files, the original file names, the file size, max file size of files set to 1 GiB
-// and the allowed file types, and possible error.
+// and the allowed file types, and possible error. When UploadedFile.Stream is set, the parts are read and written
+// one at a time as they arrive instead of parsing the whole form first.
+//
+// Files over MaxFileSize, requests over MaxTotalSize and requests with more than MaxFiles files
+// are rejected with a *FileTooLargeError, *RequestTooLargeError or *TooManyFilesError.
 func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+	return t.UploadFilesContext(r.Context(), r, uploadDir, rename...)
+}
+
+// UploadFilesContext works like UploadFiles, and stops the upload once ctx is done, such as
+// when the client disconnects or a deadline passes. The file being written is discarded, and
+// the error returned wraps ctx.Err().
+func (t *Tools) UploadFilesContext(ctx context.Context, r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+	result, err := t.UploadFormContext(ctx, r, uploadDir, rename...)
+	if result == nil {
+		return nil, err
+	}
+	return result.Files, err
+}
+
+// UploadResult holds the files saved by UploadForm along with the regular values of the form.
+type UploadResult struct {
+	Files  []*UploadedFile
+	Values url.Values
+}
+
+// maxValueBytes limits the combined size of the regular form values read in streaming mode,
+// the same limit ParseMultipartForm applies. As there, the name of every value counts toward
+// it along with valueOverhead bytes for keeping it.
+const maxValueBytes = 10 << 20
+
+// valueOverhead is what each regular form value costs on top of its name and value.
+const valueOverhead = 100
+
+// maxFormParts limits the number of parts read in streaming mode, as ParseMultipartForm does.
+const maxFormParts = 1000
+
+// UploadForm works like UploadFiles, and also returns the regular values sent in the form, such
+// as a title or an album ID. Every file records the form field it was sent in, and with
+// UploadedFile.AllowedFields set, files sent in any other field are rejected.
+//
+// Parsed forms are saved ordered by field name; streamed forms in the order they were sent.
+func (t *Tools) UploadForm(r *http.Request, uploadDir string, rename ...bool) (*UploadResult, error) {
+	return t.UploadFormContext(r.Context(), r, uploadDir, rename...)
+}
+
+// UploadFormContext works like UploadForm, and stops the upload once ctx is done.
+func (t *Tools) UploadFormContext(ctx context.Context, r *http.Request, uploadDir string, rename ...bool) (result *UploadResult, err error) {
 	renameFile := true
 	if len(rename) > 0 {
 		renameFile = rename[0]
 	}
 
-	var uploadedFiles []*UploadedFile
 	if t.UploadedFile.MaxFileSize == 0 {
 		t.UploadedFile.MaxFileSize = 1024 * 1024 * 1024
 	}
 
-	err := t.MakeDirIfNotExist(uploadDir)
-	if err != nil {
-		return nil, err
+	// other storages have no directories to create
+	if t.Storage == nil {
+		err := t.MakeDirIfNotExist(uploadDir)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	err = r.ParseMultipartForm(int64(t.UploadedFile.MaxFileSize))
+	state := &uploadState{}
+	if t.Uploader != nil {
+		state.uploader = t.Uploader(r)
+	}
+	if signed, ok := SignedURLFromContext(r.Context()); ok {
+		state.contentType = signed.ContentType
+	}
+	defer func() {
+		if err != nil && t.UploadedFile.Transactional {
+			t.rollbackUpload(ctx, state)
+			if result != nil {
+				result.Files = nil
+			}
+		}
+	}()
+
+	// reading the body is the slow part of an upload, so it stops there as soon as ctx is done
+	body := &countingBody{ReadCloser: &contextBody{ctx: ctx, ReadCloser: r.Body}}
+	r.Body = body
+
+	if t.UploadedFile.Stream {
+		result, err = t.streamUploadFiles(ctx, r, state, uploadDir, renameFile)
+		if tooLarge := requestTooLarge(err, 0, max(body.n, r.ContentLength)); tooLarge != nil {
+			err = tooLarge
+		}
+		return result, err
+	}
+
+	// the form is parsed in full before any file is looked at, so the body is capped
+	// to keep an oversized request from being spooled to disk. Allow some room for the
+	// multipart headers and regular form values on top of the files themselves.
+	limit := t.maxRequestSize()
+	if limit > 0 {
+		r.Body = http.MaxBytesReader(nil, body, limit+maxFormMemory)
+	}
+
+	err = r.ParseMultipartForm(maxFormMemory)
 	if err != nil {
-		return nil, errors.New("uploaded file is too big")
+		if tooLarge := requestTooLarge(err, limit, max(body.n, r.ContentLength)); tooLarge != nil {
+			return nil, t.rejectRequest(tooLarge)
+		}
+		return nil, fmt.Errorf("unable to parse multipart form: %w", err)
 	}
 
+	// the sizes of all parts are known up front, so check the limits before writing anything
+	err = t.checkUploadLimits(r.MultipartForm.File)
+	if err != nil {
+		return nil, t.rejectRequest(err)
+	}
+	var declared Usage
 	for _, fileHeaders := range r.MultipartForm.File {
 		for _, h := range fileHeaders {
-			uploadedFiles, err = func(uploadedFiles []*UploadedFile) ([]*UploadedFile, error) {
-				var uploadedFile UploadedFile
-				inFile, err := h.Open()
-				if err != nil {
-					return nil, err
-				}
-				defer inFile.Close()
+			declared.Bytes += h.Size
+			declared.Files++
+		}
+	}
+	err = t.checkQuota(ctx, state.uploader, declared)
+	if err != nil {
+		return nil, t.rejectRequest(err)
+	}
 
-				// buffer of 512 bytes
-				buffer := make([]byte, 512)
-				_, err = inFile.Read(buffer)
-				if err != nil {
-					return nil, err
-				}
+	result = &UploadResult{Values: url.Values(r.MultipartForm.Value)}
 
-				allowed := false
-				fileType := http.DetectContentType(buffer)
+	fields := make([]string, 0, len(r.MultipartForm.File))
+	for field := range r.MultipartForm.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
 
-				if len(t.UploadedFile.AllowedFileTypes) > 0 {
-					for _, t := range t.UploadedFile.AllowedFileTypes {
-						if strings.EqualFold(fileType, t) {
-							allowed = true
-						}
-					}
-				} else {
-					allowed = true
-				}
-				if !allowed {
-					return nil, errors.New("uploaded file type not permitted")
-				}
-				_, err = inFile.Seek(0, 0)
+	var parts []formFile
+	for _, field := range fields {
+		for _, h := range r.MultipartForm.File[field] {
+			parts = append(parts, formFile{field: field, header: h})
+		}
+	}
+
+	save := func(ctx context.Context, part formFile) (*UploadedFile, error) {
+		inFile, err := part.header.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer inFile.Close()
+		return t.saveUploadedFile(ctx, state, inFile, part.field, part.header.Filename, part.header.Size, uploadDir, renameFile)
+	}
+
+	if t.UploadedFile.Concurrency > 1 {
+		result.Files, err = t.saveConcurrently(ctx, parts, save)
+		return result, err
+	}
+	for _, part := range parts {
+		uploadedFile, err := save(ctx, part)
+		if err != nil {
+			return result, err
+		}
+		result.Files = append(result.Files, uploadedFile)
+	}
+	return result, nil
+}
+
+// formFile is a file part of a parsed multipart form.
+type formFile struct {
+	field  string
+	header *multipart.FileHeader
+}
+
+// saveConcurrently saves parts with up to UploadedFile.Concurrency calls of save at a time.
+// The first error cancels the context passed to the files still being saved and keeps the
+// rest from starting. The files saved are returned in the order of parts.
+func (t *Tools) saveConcurrently(ctx context.Context, parts []formFile, save func(context.Context, formFile) (*UploadedFile, error)) ([]*UploadedFile, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	saved := make([]*UploadedFile, len(parts))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	next := make(chan int)
+	for w := 0; w < min(t.UploadedFile.Concurrency, len(parts)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				uploadedFile, err := save(ctx, parts[i])
 				if err != nil {
-					return nil, err
-				}
-				if renameFile {
-					uploadedFile.NewFileName = fmt.Sprintf("%s%s", t.RandomString(25), filepath.Ext(h.Filename))
-				} else {
-					uploadedFile.NewFileName = h.Filename
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					mu.Unlock()
+					continue
 				}
+				saved[i] = uploadedFile
+			}
+		}()
+	}
 
-				uploadedFile.OrigFileName = h.Filename
-				var outFile *os.File
-				defer outFile.Close()
+dispatch:
+	for i := range parts {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(next)
+	wg.Wait()
 
-				if outFile, err = os.Create(filepath.Join(uploadDir, uploadedFile.NewFileName)); err != nil {
-					return nil, err
-				} else {
-					fileSize, err := io.Copy(outFile, inFile)
-					if err != nil {
-						return nil, err
-					}
-					uploadedFile.FileSize = fileSize
+	files := make([]*UploadedFile, 0, len(parts))
+	for _, f := range saved {
+		if f != nil {
+			files = append(files, f)
+		}
+	}
+	if firstErr == nil && len(files) < len(parts) {
+		// the request was cancelled before every file was started
+		firstErr = ctx.Err()
+	}
+	return files, firstErr
+}
+
+// countingBody is a request body that counts the bytes read from it.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// requestTooLarge returns a *RequestTooLargeError when err comes from a request body cut off
+// by an http.MaxBytesReader, and nil otherwise. The reader is either the one capping a parsed
+// form at limit plus maxFormMemory, or one set before the request reached Tools, such as by
+// URLSigner.Middleware for a signed MaxSize, whose own limit is reported. size is the size
+// of the body, as far as it is known.
+func requestTooLarge(err error, limit, size int64) *RequestTooLargeError {
+	var maxBytesError *http.MaxBytesError
+	if !errors.As(err, &maxBytesError) {
+		return nil
+	}
+	if limit > 0 && maxBytesError.Limit == limit+maxFormMemory {
+		return &RequestTooLargeError{Limit: limit, Size: size}
+	}
+	return &RequestTooLargeError{Limit: maxBytesError.Limit, Size: size}
+}
+
+// maxRequestSize returns the most bytes of files a parsed request may hold: MaxTotalSize,
+// or when it is not set, MaxFileSize times MaxFiles. It returns 0 when neither limits the
+// request as a whole.
+func (t *Tools) maxRequestSize() int64 {
+	if t.UploadedFile.MaxTotalSize > 0 {
+		return int64(t.UploadedFile.MaxTotalSize)
+	}
+	if t.UploadedFile.MaxFiles > 0 {
+		return int64(t.UploadedFile.MaxFileSize) * int64(t.UploadedFile.MaxFiles)
+	}
+	return 0
+}
+
+// contextBody is a request body that fails with the error of ctx once it is done.
+type contextBody struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (b *contextBody) Read(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// isAllowedField reports whether files may be sent in the form field named field.
+func (t *Tools) isAllowedField(field string) bool {
+	if len(t.UploadedFile.AllowedFields) == 0 {
+		return true
+	}
+	for _, allowed := range t.UploadedFile.AllowedFields {
+		if field == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// rollbackUpload removes the files saved so far by a failed transactional upload. It keeps
+// going when the request has been cancelled, since that is one of the ways an upload fails.
+func (t *Tools) rollbackUpload(ctx context.Context, state *uploadState) {
+	ctx = context.WithoutCancel(ctx)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, key := range state.saved {
+		_ = t.storage().Delete(ctx, key)
+	}
+	for _, id := range state.cataloged {
+		_ = t.Catalog.Delete(ctx, id)
+	}
+	if state.usage != (Usage{}) && (t.Quota.MaxBytes > 0 || t.Quota.MaxFiles > 0) {
+		_ = t.Quota.usage().Release(ctx, state.uploader, state.usage)
+	}
+	state.saved = nil
+	state.cataloged = nil
+	state.usage = Usage{}
+}
+
+// checkUploadLimits compares the file headers of a parsed form against AllowedFields,
+// MaxFiles, MaxFileSize and MaxTotalSize.
+func (t *Tools) checkUploadLimits(files map[string][]*multipart.FileHeader) error {
+	count := 0
+	var total int64
+	for field, fileHeaders := range files {
+		if !t.isAllowedField(field) {
+			return &UnexpectedFieldError{FieldName: field}
+		}
+		for _, h := range fileHeaders {
+			count++
+			total += h.Size
+			if h.Size > int64(t.UploadedFile.MaxFileSize) {
+				return &FileTooLargeError{FileName: h.Filename, Limit: int64(t.UploadedFile.MaxFileSize), Size: h.Size}
+			}
+		}
+	}
+
+	if t.UploadedFile.MaxFiles > 0 && count > t.UploadedFile.MaxFiles {
+		return &TooManyFilesError{Limit: t.UploadedFile.MaxFiles, Count: count}
+	}
+	if t.UploadedFile.MaxTotalSize > 0 && total > int64(t.UploadedFile.MaxTotalSize) {
+		return &RequestTooLargeError{Limit: int64(t.UploadedFile.MaxTotalSize), Size: total}
+	}
+	return nil
+}
+
+// streamUploadFiles reads the multipart body part by part and saves every file part
+// as soon as it is reached. Parts without a file name are regular form values.
+func (t *Tools) streamUploadFiles(ctx context.Context, r *http.Request, state *uploadState, uploadDir string, renameFile bool) (*UploadResult, error) {
+	result := &UploadResult{Values: url.Values{}}
+	valueBytes, parts := 0, 0
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		if parts++; parts > maxFormParts {
+			part.Close()
+			return result, errors.New("multipart form has too many parts")
+		}
+
+		if part.FileName() == "" {
+			valueBytes += len(part.FormName()) + valueOverhead
+			if valueBytes > maxValueBytes {
+				part.Close()
+				return result, errors.New("multipart form values are too large")
+			}
+			value, err := io.ReadAll(io.LimitReader(part, int64(maxValueBytes-valueBytes+1)))
+			part.Close()
+			if err != nil {
+				return result, err
+			}
+			valueBytes += len(value)
+			if valueBytes > maxValueBytes {
+				return result, errors.New("multipart form values are too large")
+			}
+			result.Values.Add(part.FormName(), string(value))
+			continue
+		}
+
+		if !t.isAllowedField(part.FormName()) {
+			part.Close()
+			return result, t.rejectRequest(&UnexpectedFieldError{FieldName: part.FormName()})
+		}
+
+		uploadedFile, err := t.saveUploadedFile(ctx, state, part, part.FormName(), part.FileName(), -1, uploadDir, renameFile)
+		part.Close()
+		if err != nil {
+			return result, err
+		}
+		result.Files = append(result.Files, uploadedFile)
+	}
+	return result, nil
+}
+
+// saveUploadedFile saves a single file with writeUploadedFile, records it in Tools.Catalog
+// and reports its progress through OnUploadEvent. fieldName is the form field the file was
+// sent in, if any, and size the size announced by the client, or -1 when unknown.
+func (t *Tools) saveUploadedFile(ctx context.Context, state *uploadState, src io.Reader, fieldName, fileName string, size int64, uploadDir string, renameFile bool) (*UploadedFile, error) {
+	event := UploadEvent{FieldName: fieldName, FileName: fileName, Size: size}
+	emit := func(typ UploadEventType, written int64, f *UploadedFile, err error) {
+		e := event
+		e.Type, e.Written, e.File, e.Err = typ, written, f, err
+		t.emit(e)
+	}
+	emit(UploadStarted, 0, nil, nil)
+
+	quota, err := t.reserveQuota(ctx, state.uploader, size)
+	if err != nil {
+		emit(UploadRejected, 0, nil, err)
+		return nil, err
+	}
+
+	var progress func(int64)
+	if t.OnUploadEvent != nil {
+		progress = func(written int64) {
+			emit(UploadProgress, written, nil, nil)
+		}
+	}
+
+	uploadedFile, written, err := t.writeUploadedFile(ctx, state, src, fileName, uploadDir, renameFile, progress, quota)
+	if err == nil {
+		uploadedFile.FieldName = fieldName
+		if t.Catalog != nil {
+			err = t.catalogUpload(ctx, state, uploadedFile, uploadDir)
+		}
+	}
+	if err != nil {
+		quota.settle(ctx, Usage{})
+		emit(UploadRejected, written, nil, err)
+		return nil, err
+	}
+	stored := Usage{Bytes: uploadedFile.FileSize, Files: 1}
+	quota.settle(ctx, stored)
+	state.mu.Lock()
+	state.usage.Bytes += stored.Bytes
+	state.usage.Files += stored.Files
+	state.mu.Unlock()
+	emit(UploadFinished, written, uploadedFile, nil)
+	return uploadedFile, nil
+}
+
+// writeUploadedFile checks the file type of src, then stores it in uploadDir through t's Storage.
+// The copy is cut off as soon as the file or the request as a whole goes over its size limit,
+// and the partial file is discarded. It also returns how many bytes of the file were read.
+func (t *Tools) writeUploadedFile(ctx context.Context, state *uploadState, src io.Reader, fileName, uploadDir string, renameFile bool, progress func(int64), quota *quotaReservation) (*UploadedFile, int64, error) {
+	var uploadedFile UploadedFile
+	stored := false
+
+	state.mu.Lock()
+	state.files++
+	files := state.files
+	state.mu.Unlock()
+	if t.UploadedFile.MaxFiles > 0 && files > t.UploadedFile.MaxFiles {
+		return nil, 0, &TooManyFilesError{Limit: t.UploadedFile.MaxFiles, Count: files}
+	}
+
+	// read enough of the file to detect its type
+	buffer := make([]byte, sniffLen)
+	n, err := io.ReadFull(src, buffer)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, 0, err
+	}
+	buffer = buffer[:n]
+
+	fileType := t.fileTypes().Detect(buffer)
+	if !t.isAllowedFileType(fileType) || (state.contentType != "" && fileType != state.contentType) {
+		return nil, 0, errFileTypeNotPermitted
+	}
+	uploadedFile.ContentType = fileType
+
+	// a renamed file only keeps the extension of its name, so a name that can not be
+	// sanitized is only an error when it is going to be used as it is
+	name, err := t.SanitizeFilename(fileName)
+	if err != nil && !renameFile {
+		return nil, 0, err
+	}
+	ext, err := t.uploadExtension(name, fileType)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if renameFile {
+		uploadedFile.NewFileName = fmt.Sprintf("%s%s", t.RandomString(25), ext)
+	} else {
+		uploadedFile.NewFileName = strings.TrimSuffix(name, filepath.Ext(name)) + ext
+	}
+	uploadedFile.OrigFileName = fileName
+
+	var key string
+	if !t.UploadedFile.ContentAddressed {
+		var claimed bool
+		uploadedFile.NewFileName, claimed, err = t.resolveCollision(ctx, state, uploadDir, uploadedFile.NewFileName)
+		if err != nil {
+			return nil, 0, err
+		}
+		key, err = confinedKey(uploadDir, uploadedFile.NewFileName)
+		if err != nil {
+			return nil, 0, err
+		}
+		if claimed {
+			// the empty file claiming the name goes away again when the file is not stored
+			defer func() {
+				if !stored {
+					_ = t.storage().Delete(context.WithoutCancel(ctx), key)
 				}
-				uploadedFiles = append(uploadedFiles, &uploadedFile)
-				return uploadedFiles, nil
-			}(uploadedFiles)
+			}()
+		}
+	}
+
+	hashAlg, err := t.hashAlgorithm()
+	if err != nil {
+		return nil, 0, err
+	}
+	hasher := hashAlg.New()
+
+	maxFile := int64(t.UploadedFile.MaxFileSize)
+	if state.maxFileSize > 0 {
+		maxFile = state.maxFileSize
+	}
+	in := &uploadLimitReader{
+		ctx:      ctx,
+		r:        io.MultiReader(bytes.NewReader(buffer), src),
+		fileName: fileName,
+		maxFile:  maxFile,
+		maxTotal: int64(t.UploadedFile.MaxTotalSize),
+		state:    state,
+		progress: progress,
+		quota:    quota,
+	}
+
+	// scanned files and images are read in full before anything is stored, and what is
+	// stored may be a re-encoded image, so the checksum is computed over the processed content
+	var content io.Reader = in
+	var thumbs []thumbnail
+	if t.Scanner != nil || t.UploadedFile.Image.applies(fileType) {
+		spool, _, err := spoolFile(in)
+		if err != nil {
+			if in.err != nil {
+				return nil, in.read, in.err
+			}
+			return nil, in.read, err
+		}
+		defer removeSpool(spool)
+		content = spool
+
+		if t.Scanner != nil {
+			if err := t.scan(ctx, fileName, spool); err != nil {
+				return nil, in.read, err
+			}
+		}
+		if t.UploadedFile.Image.applies(fileType) {
+			content, thumbs, err = t.processImage(spool, fileName, fileType)
 			if err != nil {
-				return uploadedFiles, err
+				return nil, in.read, err
 			}
 		}
 	}
-	return uploadedFiles, nil
+
+	if t.UploadedFile.ContentAddressed {
+		uploadedFile.NewFileName, uploadedFile.FileSize, uploadedFile.Duplicate, err = t.putContentAddressed(ctx, content, hasher, uploadDir)
+		key = storageKey(uploadDir, uploadedFile.NewFileName)
+	} else {
+		uploadedFile.FileSize, err = t.storage().Put(ctx, key, io.TeeReader(content, hasher))
+	}
+	if err != nil {
+		// the limit errors are returned as they are, not wrapped by the storage
+		if in.err != nil {
+			return nil, in.read, in.err
+		}
+		return nil, in.read, err
+	}
+	stored = true
+	// a reused content addressed file belongs to earlier uploads, so it is never rolled back
+	if !uploadedFile.Duplicate {
+		state.addSaved(key)
+	}
+	uploadedFile.HashAlgorithm = hashAlg
+	uploadedFile.Checksum = hex.EncodeToString(hasher.Sum(nil))
+
+	if err := t.storeThumbnails(ctx, state, &uploadedFile, uploadDir, thumbs); err != nil {
+		return nil, in.read, err
+	}
+
+	return &uploadedFile, in.read, nil
+}
+
+// uploadLimitReader reads a single file from r and fails as soon as the file goes over
+// maxFile bytes, or the request as a whole goes over maxTotal bytes, so a Storage being
+// written to sees the error and discards what it has stored so far. It fails the same way
+// once ctx is cancelled.
+type uploadLimitReader struct {
+	ctx      context.Context
+	r        io.Reader
+	fileName string
+	read     int64
+	maxFile  int64
+	maxTotal int64
+	state    *uploadState
+	err      error
+	// progress, when set, is called with the bytes read so far after every read
+	progress func(int64)
+	// quota, when set, is grown as the file is read, failing it once the quota is used up
+	quota *quotaReservation
+}
+
+func (l *uploadLimitReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if l.ctx != nil {
+		if l.err = l.ctx.Err(); l.err != nil {
+			return 0, l.err
+		}
+	}
+
+	// never read more than one byte past either limit
+	l.state.mu.Lock()
+	total := l.state.total
+	l.state.mu.Unlock()
+	room := l.maxFile - l.read
+	if l.maxTotal > 0 && l.maxTotal-total < room {
+		room = l.maxTotal - total
+	}
+	if int64(len(p)) > room+1 {
+		p = p[:room+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	l.state.mu.Lock()
+	l.state.total += int64(n)
+	total = l.state.total
+	l.state.mu.Unlock()
+	if n > 0 && l.progress != nil {
+		l.progress(l.read)
+	}
+	switch {
+	case l.read > l.maxFile:
+		l.err = &FileTooLargeError{FileName: l.fileName, Limit: l.maxFile, Size: l.read}
+	case l.maxTotal > 0 && total > l.maxTotal:
+		l.err = &RequestTooLargeError{Limit: l.maxTotal, Size: total}
+	case l.quota != nil:
+		l.err = l.quota.grow(l.ctx, l.read)
+	}
+	if l.err != nil {
+		return n, l.err
+	}
+	return n, err
 }
 
 // MakeDirIfNotExist creates a directory, and all necessary parents, if it does not exist
@@ -164,6 +890,12 @@ func (t *Tools) MakeDirIfNotExist(path string) error {
 // CleanDirectory removes all files in a directory. os.RemoveAll is a similar function but
 // removes everything and its path.
 func (t *Tools) CleanDirectory(path string) error {
+	return t.CleanDirectoryContext(context.Background(), path)
+}
+
+// CleanDirectoryContext works like CleanDirectory, and stops before the next file once ctx
+// is done, returning ctx.Err().
+func (t *Tools) CleanDirectoryContext(ctx context.Context, path string) error {
 	dir, err := os.Open(path)
 	if err != nil {
 		return err
@@ -176,6 +908,9 @@ func (t *Tools) CleanDirectory(path string) error {
 	}
 
 	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		err = os.Remove(fmt.Sprintf("%s/%s", path, f))
 		if err != nil {
 			return err
@@ -202,17 +937,230 @@ func (t *Tools) Slugify(s string) (string, error) {
 // DownloadStaticFile handles the download of a file from the server.
 // It sets the appropriate headers to force the browser to download the file
 // instead of displaying it inline. This function allows specifying a custom
-// display name for the downloaded file.
-func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, pathName, displayName string) {
+// display name for the downloaded file. Pass DownloadOptions to detect the content type or
+// let the browser display the file instead.
+//
+// pathName must not come from the client unless Tools.DownloadRoot is set.
+func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, pathName, displayName string, opts ...DownloadOptions) {
+	key := filepath.ToSlash(pathName)
+	if t.DownloadRoot != "" {
+		var err error
+		key, err = t.confinedDownloadKey(pathName)
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+	}
+	t.serveKey(w, r, key, displayName, opts...)
+}
 
-	if _, err := os.Stat(pathName); os.IsNotExist(err) {
+// confinedDownloadKey resolves pathName inside Tools.DownloadRoot. It fails for names that
+// lead outside of it, and for dotfiles unless Tools.AllowDotFiles is set. On the local disk,
+// symbolic links are followed to make sure they stay inside as well.
+func (t *Tools) confinedDownloadKey(pathName string) (string, error) {
+	notFound := &fs.PathError{Op: "open", Path: pathName, Err: fs.ErrNotExist}
+
+	// backslashes are separators on Windows, so they are never let through as part of a name
+	name := strings.ReplaceAll(pathName, `\`, "/")
+	if strings.ContainsRune(name, 0) {
+		return "", notFound
+	}
+	key, err := confinedKey(t.DownloadRoot, name)
+	if err != nil {
+		return "", notFound
+	}
+	if !t.AllowDotFiles && hasDotSegment(path.Clean("/"+name)) {
+		return "", notFound
+	}
+
+	disk, ok := asDiskStorage(t.storage())
+	if !ok {
+		return key, nil
+	}
+	root, err := filepath.EvalSymlinks(disk.path(t.DownloadRoot))
+	if err != nil {
+		return "", notFound
+	}
+	real, err := filepath.EvalSymlinks(disk.path(key))
+	if err != nil {
+		return "", notFound
+	}
+	rel, err := filepath.Rel(root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", notFound
+	}
+	// a link may lead to a dotfile under another name
+	if !t.AllowDotFiles && hasDotSegment(filepath.ToSlash(rel)) {
+		return "", notFound
+	}
+	return key, nil
+}
+
+// hasDotSegment reports whether any element of the slash separated path p starts with a dot.
+func hasDotSegment(p string) bool {
+	for _, elem := range strings.Split(p, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveKey sends the file stored under key as a download named displayName.
+func (t *Tools) serveKey(w http.ResponseWriter, r *http.Request, key, displayName string, opts ...DownloadOptions) {
+	store := t.storage()
+
+	info, err := store.Stat(r.Context(), key)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	file, err := store.Get(r.Context(), key)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	t.touch(r.Context(), key)
+
+	t.serveDownload(w, r, file, info.Size, info.ModTime, key, displayName, opts...)
+}
+
+// DownloadFromFS works like DownloadStaticFile, serving the file called name from fsys
+// instead, such as an embed.FS or a zip.Reader. Names are slash separated and relative to
+// the root of fsys, as fs.ValidPath requires; anything else, and directories, get a 404.
+func (t *Tools) DownloadFromFS(w http.ResponseWriter, r *http.Request, fsys fs.FS, name, displayName string, opts ...DownloadOptions) {
+	if !fs.ValidPath(name) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	file, err := fsys.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if info.IsDir() {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
-	w.Header().Set("Content-Type", "application/octet-stream")
 
-	http.ServeFile(w, r, pathName)
+	// range requests need to seek, so files that can only be read in order, such as zip
+	// entries, are read at an offset when they allow it, and buffered otherwise: in memory when
+	// they are small, in a temporary file when they are not. Other requests stream them.
+	var content io.Reader = file
+	_, seeks := file.(io.Seeker)
+	ra, readsAt := file.(io.ReaderAt)
+	switch {
+	case seeks:
+	case readsAt:
+		content = io.NewSectionReader(ra, 0, info.Size())
+	case r.Header.Get("Range") == "":
+		// serveDownload answers anything but a range request without seeking
+	case info.Size() <= maxBufferedDownload:
+		data, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(data)
+	default:
+		spool, _, err := spoolFile(file)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer removeSpool(spool)
+		content = spool
+	}
+	t.serveDownload(w, r, content, info.Size(), info.ModTime(), name, displayName, opts...)
+}
+
+// maxBufferedDownload is the largest file DownloadFromFS buffers in memory when it can not
+// seek in it.
+const maxBufferedDownload = 1 << 20
+
+// serveDownload writes content, stored under name, to w as a download named displayName.
+// Seekable content gets range and conditional request support. Anything else gets conditional
+// request support too, but is sent in full when a range is asked for.
+func (t *Tools) serveDownload(w http.ResponseWriter, r *http.Request, content io.Reader, size int64, modTime time.Time, name, displayName string, opts ...DownloadOptions) {
+	var opt DownloadOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	contentType := "application/octet-stream"
+	if opt.DetectContentType {
+		var err error
+		contentType, content, err = t.downloadContentType(content, name, displayName)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	disposition := DispositionAttachment
+	if opt.Inline {
+		disposition = DispositionInline
+	}
+
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, displayName))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if opt.ContentSecurityPolicy != "" {
+		w.Header().Set("Content-Security-Policy", opt.ContentSecurityPolicy)
+	}
+
+	rs, ok := content.(io.ReadSeeker)
+	if !ok && r.Header.Get("Range") == "" {
+		rs, ok = &sizedReader{Reader: content, size: size}, true
+	}
+	if ok {
+		http.ServeContent(w, r, displayName, modTime, rs)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if r.Method != http.MethodHead {
+		_, _ = io.Copy(w, content)
+	}
+}
+
+// sizedReader lets content that can only be read in order go through http.ServeContent when
+// no range is asked for, as it then only seeks to the end to learn the size, and back to the
+// start before reading.
+type sizedReader struct {
+	io.Reader
+	size int64
+	read bool
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	s.read = true
+	return s.Reader.Read(p)
+}
+
+func (s *sizedReader) Seek(offset int64, whence int) (int64, error) {
+	switch {
+	case offset == 0 && whence == io.SeekEnd:
+		return s.size, nil
+	case offset == 0 && whence == io.SeekStart && !s.read:
+		return 0, nil
+	}
+	return 0, errors.New("toolbox: content can only be read in order")
 }
 
 // JSONResponse is a struct used to pass JSON data around
@@ -316,6 +1264,11 @@ func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error
 // It allows for an optional custom HTTP client and returns the HTTP response, status code,
 // and an error if any occurred during the process.
 func (t *Tools) PostJSONWithClient(uri string, data interface{}, client ...*http.Client) (*http.Response, int, error) {
+	return t.PostJSONContext(context.Background(), uri, data, client...)
+}
+
+// PostJSONContext works like PostJSONWithClient, and cancels the request once ctx is done.
+func (t *Tools) PostJSONContext(ctx context.Context, uri string, data interface{}, client ...*http.Client) (*http.Response, int, error) {
 	// Create json
 	jsonData, err := json.Marshal(data)
 	if err != nil {
@@ -327,7 +1280,7 @@ func (t *Tools) PostJSONWithClient(uri string, data interface{}, client ...*http
 		httpClient = client[0]
 	}
 	// build request and set header
-	req, err := http.NewRequest("POST", uri, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -1,19 +1,29 @@
 package toolbox
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"image/png"
 	"io"
+	"io/fs"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 type RoundTripFunc func(req *http.Request) *http.Response
@@ -49,6 +59,25 @@ func TestTools_PostJSONWithClient(t *testing.T) {
 	}
 }
 
+func TestTools_PostJSONContext(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// never answers, so only the deadline ends the request
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var testTools Tools
+	_, _, err := testTools.PostJSONContext(ctx, srv.URL, map[string]string{"bar": "bar"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
 func TestTools_RandomString(t *testing.T) {
 	var testTools Tools
 
@@ -198,6 +227,638 @@ func TestTools_UploadAFile(t *testing.T) {
 	cleanDirectory("./testdata/uploads")
 }
 
+// testPNG encodes a small generated image so tests do not depend on files in testdata
+func testPNG(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 48; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 5), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testPart is one part of a multipart request built by newMultipartRequest. Parts
+// without a file name are written as regular form values.
+type testPart struct {
+	field    string
+	fileName string
+	data     []byte
+}
+
+func newMultipartRequest(t *testing.T, parts ...testPart) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, p := range parts {
+		var w io.Writer
+		var err error
+		if p.fileName == "" {
+			w, err = writer.CreateFormField(p.field)
+		} else {
+			w, err = writer.CreateFormFile(p.field, p.fileName)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(p.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/", &body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+var streamUploadTests = []struct {
+	name          string
+	allowedTypes  []string
+	maxFileSize   int
+	renameFile    bool
+	errorExpected bool
+}{
+	{name: "allowed no rename", allowedTypes: []string{"image/png"}, renameFile: false, errorExpected: false},
+	{name: "allowed rename", allowedTypes: []string{"image/png"}, renameFile: true, errorExpected: false},
+	{name: "not allowed", allowedTypes: []string{"image/jpeg"}, renameFile: true, errorExpected: true},
+	{name: "too big", maxFileSize: 100, renameFile: false, errorExpected: true},
+}
+
+func TestTools_UploadFilesStream(t *testing.T) {
+	pngData := testPNG(t)
+	uploadDir := t.TempDir()
+
+	for _, e := range streamUploadTests {
+		req := newMultipartRequest(t,
+			testPart{field: "title", data: []byte("a title")},
+			testPart{field: "file", fileName: "img.png", data: pngData},
+			testPart{field: "file", fileName: "img2.png", data: pngData},
+		)
+
+		var testTools Tools
+		testTools.UploadedFile.Stream = true
+		testTools.UploadedFile.AllowedFileTypes = e.allowedTypes
+		testTools.UploadedFile.MaxFileSize = e.maxFileSize
+
+		uploadedFiles, err := testTools.UploadFiles(req, uploadDir, e.renameFile)
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected but none received", e.name)
+			}
+			if _, err := os.Stat(filepath.Join(uploadDir, "img.png")); !os.IsNotExist(err) {
+				t.Errorf("%s: rejected file left in upload directory", e.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+
+		if len(uploadedFiles) != 2 {
+			t.Errorf("%s: wrong number of files. wanted=2, got=%d", e.name, len(uploadedFiles))
+			continue
+		}
+		for _, f := range uploadedFiles {
+			if f.FileSize != int64(len(pngData)) {
+				t.Errorf("%s: wrong file size. wanted=%d, got=%d", e.name, len(pngData), f.FileSize)
+			}
+			if _, err := os.Stat(filepath.Join(uploadDir, f.NewFileName)); err != nil {
+				t.Errorf("%s: expected file to exist: %s", e.name, err)
+			}
+		}
+		_ = cleanDirectory(uploadDir)
+	}
+}
+
+var uploadLimitTests = []struct {
+	name         string
+	maxFileSize  int
+	maxTotalSize int
+	maxFiles     int
+	expected     interface{}
+}{
+	{name: "within limits", maxFileSize: 100, maxTotalSize: 300, maxFiles: 3, expected: nil},
+	{name: "file too large", maxFileSize: 50, expected: &FileTooLargeError{}},
+	{name: "request too large", maxFileSize: 100, maxTotalSize: 150, expected: &RequestTooLargeError{}},
+	{name: "too many files", maxFiles: 2, expected: &TooManyFilesError{}},
+}
+
+func TestTools_UploadFilesLimits(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 80)
+
+	for _, stream := range []bool{false, true} {
+		for _, e := range uploadLimitTests {
+			name := fmt.Sprintf("%s (stream=%t)", e.name, stream)
+			req := newMultipartRequest(t,
+				testPart{field: "file", fileName: "a.txt", data: data},
+				testPart{field: "file", fileName: "b.txt", data: data},
+				testPart{field: "file", fileName: "c.txt", data: data},
+			)
+
+			var testTools Tools
+			testTools.Storage = &MemoryStorage{}
+			testTools.UploadedFile.Stream = stream
+			testTools.UploadedFile.MaxFileSize = e.maxFileSize
+			testTools.UploadedFile.MaxTotalSize = e.maxTotalSize
+			testTools.UploadedFile.MaxFiles = e.maxFiles
+
+			_, err := testTools.UploadFiles(req, "uploads")
+			switch expected := e.expected.(type) {
+			case nil:
+				if err != nil {
+					t.Errorf("%s: unexpected error: %s", name, err)
+				}
+			case *FileTooLargeError:
+				if !errors.As(err, &expected) {
+					t.Errorf("%s: expected *FileTooLargeError, got %v", name, err)
+				} else if expected.Limit != 50 || expected.Size <= 50 || expected.FileName == "" {
+					t.Errorf("%s: wrong error details: %+v", name, expected)
+				}
+			case *RequestTooLargeError:
+				if !errors.As(err, &expected) {
+					t.Errorf("%s: expected *RequestTooLargeError, got %v", name, err)
+				} else if expected.Limit != 150 || expected.Size <= 150 {
+					t.Errorf("%s: wrong error details: %+v", name, expected)
+				}
+			case *TooManyFilesError:
+				if !errors.As(err, &expected) {
+					t.Errorf("%s: expected *TooManyFilesError, got %v", name, err)
+				} else if expected.Limit != 2 || expected.Count != 3 {
+					t.Errorf("%s: wrong error details: %+v", name, expected)
+				}
+			}
+		}
+	}
+}
+
+// zeroReader reads zeros, counting how many it has handed out.
+type zeroReader struct{ n int64 }
+
+func (z *zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	z.n += int64(len(p))
+	return len(p), nil
+}
+
+var uploadBodyCapTests = []struct {
+	name          string
+	maxFileSize   int
+	maxTotalSize  int
+	maxFiles      int
+	knownLength   bool
+	fileTooLarge  bool
+	expectedLimit int64
+}{
+	{name: "total size", maxTotalSize: 1 << 20, knownLength: true, expectedLimit: 1 << 20},
+	{name: "file size", maxFileSize: 1 << 20, fileTooLarge: true, expectedLimit: 1 << 20},
+	{name: "file size and count", maxFileSize: 1 << 20, maxFiles: 3, expectedLimit: 3 << 20},
+}
+
+func TestTools_UploadFilesBodyCap(t *testing.T) {
+	const bodySize = 36 << 20
+	head := "--b\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\n\r\n"
+	tail := "\r\n--b--\r\n"
+
+	for _, e := range uploadBodyCapTests {
+		zeros := &zeroReader{}
+		body := io.MultiReader(strings.NewReader(head), io.LimitReader(zeros, bodySize), strings.NewReader(tail))
+		req := httptest.NewRequest("POST", "/upload", body)
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+		if e.knownLength {
+			req.ContentLength = int64(len(head) + bodySize + len(tail))
+		}
+
+		var testTools Tools
+		testTools.Storage = &MemoryStorage{}
+		testTools.UploadedFile.MaxFileSize = e.maxFileSize
+		testTools.UploadedFile.MaxTotalSize = e.maxTotalSize
+		testTools.UploadedFile.MaxFiles = e.maxFiles
+
+		_, err := testTools.UploadFiles(req, "uploads")
+		if e.fileTooLarge {
+			// without a limit on the whole request, the body is read and the file is rejected by name
+			var fileTooLarge *FileTooLargeError
+			if !errors.As(err, &fileTooLarge) {
+				t.Errorf("%s: expected *FileTooLargeError, got %v", e.name, err)
+				continue
+			}
+			if fileTooLarge.FileName != "a.txt" || fileTooLarge.Limit != e.expectedLimit {
+				t.Errorf("%s: wrong error. wanted file a.txt and limit %d, got %v", e.name, e.expectedLimit, err)
+			}
+			continue
+		}
+
+		var tooLarge *RequestTooLargeError
+		if !errors.As(err, &tooLarge) {
+			t.Errorf("%s: expected *RequestTooLargeError, got %v", e.name, err)
+			continue
+		}
+		if tooLarge.Limit != e.expectedLimit {
+			t.Errorf("%s: wrong limit. wanted=%d, got=%d", e.name, e.expectedLimit, tooLarge.Limit)
+		}
+		// the size is what was sent, or read before the body was cut off, never the cap itself
+		if e.knownLength && tooLarge.Size != req.ContentLength {
+			t.Errorf("%s: wrong size. wanted=%d, got=%d", e.name, req.ContentLength, tooLarge.Size)
+		}
+		if !e.knownLength && (tooLarge.Size <= e.expectedLimit || tooLarge.Size > zeros.n+int64(len(head))) {
+			t.Errorf("%s: wrong size. got=%d, read=%d", e.name, tooLarge.Size, zeros.n)
+		}
+		if zeros.n >= bodySize {
+			t.Errorf("%s: expected the body to be cut off, read all %d bytes", e.name, zeros.n)
+		}
+	}
+}
+
+func TestTools_UploadFilesNoRequestLimit(t *testing.T) {
+	const files, fileSize = 40, 1 << 20
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		defer pw.Close()
+		defer writer.Close()
+		for i := 0; i < files; i++ {
+			part, err := writer.CreateFormFile("file", fmt.Sprintf("%d.txt", i))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.CopyN(part, &zeroReader{}, fileSize); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+
+	req := httptest.NewRequest("POST", "/upload", pr)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	var testTools Tools
+	testTools.Storage = &MemoryStorage{}
+	testTools.UploadedFile.MaxFileSize = 2 << 20
+
+	uploaded, err := testTools.UploadFiles(req, "uploads", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploaded) != files {
+		t.Errorf("wrong number of files. wanted=%d, got=%d", files, len(uploaded))
+	}
+}
+
+var uploadFormTests = []struct {
+	name          string
+	stream        bool
+	allowedFields []string
+	errorExpected bool
+}{
+	{name: "parsed", stream: false},
+	{name: "streamed", stream: true},
+	{name: "allowed fields", stream: false, allowedFields: []string{"avatar", "cover"}},
+	{name: "unexpected field", stream: false, allowedFields: []string{"avatar"}, errorExpected: true},
+	{name: "unexpected field streamed", stream: true, allowedFields: []string{"avatar"}, errorExpected: true},
+}
+
+func TestTools_UploadForm(t *testing.T) {
+	pngData := testPNG(t)
+
+	for _, e := range uploadFormTests {
+		var testTools Tools
+		testTools.Storage = &MemoryStorage{}
+		testTools.UploadedFile.Stream = e.stream
+		testTools.UploadedFile.AllowedFields = e.allowedFields
+
+		req := newMultipartRequest(t,
+			testPart{field: "title", data: []byte("Holiday")},
+			testPart{field: "cover", fileName: "cover.png", data: pngData},
+			testPart{field: "album_id", data: []byte("42")},
+			testPart{field: "avatar", fileName: "me.png", data: pngData},
+		)
+		result, err := testTools.UploadForm(req, "uploads")
+
+		var unexpected *UnexpectedFieldError
+		if e.errorExpected {
+			if !errors.As(err, &unexpected) || unexpected.FieldName != "cover" {
+				t.Errorf("%s: expected *UnexpectedFieldError for cover, got %v", e.name, err)
+			}
+			list, _ := testTools.Storage.List(context.Background(), "uploads/")
+			if len(list) != 0 {
+				t.Errorf("%s: files stored from a rejected form: %v", e.name, list)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+
+		if result.Values.Get("title") != "Holiday" || result.Values.Get("album_id") != "42" {
+			t.Errorf("%s: wrong form values: %v", e.name, result.Values)
+		}
+		if len(result.Files) != 2 {
+			t.Errorf("%s: wrong number of files. wanted=2, got=%d", e.name, len(result.Files))
+			continue
+		}
+		fields := map[string]string{}
+		for _, f := range result.Files {
+			fields[f.FieldName] = f.OrigFileName
+		}
+		if fields["cover"] != "cover.png" || fields["avatar"] != "me.png" {
+			t.Errorf("%s: wrong field names: %v", e.name, fields)
+		}
+	}
+}
+
+var uploadFormStreamLimitTests = []struct {
+	name     string
+	parts    int
+	nameSize int
+}{
+	{name: "too many parts", parts: maxFormParts + 1, nameSize: 10},
+	{name: "long names", parts: 200, nameSize: 60 << 10},
+}
+
+func TestTools_UploadFormStreamLimits(t *testing.T) {
+	for _, e := range uploadFormStreamLimitTests {
+		// every part is an empty value, so only the names and the number of parts add up
+		var body strings.Builder
+		for i := 0; i < e.parts; i++ {
+			name := fmt.Sprintf("%0*d", e.nameSize, i)
+			fmt.Fprintf(&body, "--b\r\nContent-Disposition: form-data; name=\"%s\"\r\n\r\n\r\n", name)
+		}
+		body.WriteString("--b--\r\n")
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(body.String()))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+
+		var testTools Tools
+		testTools.Storage = &MemoryStorage{}
+		testTools.UploadedFile.Stream = true
+
+		result, err := testTools.UploadForm(req, "uploads")
+		if err == nil {
+			t.Errorf("%s: expected an error, got %d values", e.name, len(result.Values))
+		}
+	}
+}
+
+// scanFunc is a Scanner calling itself.
+type scanFunc func(ctx context.Context, fileName string, r io.Reader) error
+
+func (f scanFunc) Scan(ctx context.Context, fileName string, r io.Reader) error {
+	return f(ctx, fileName, r)
+}
+
+func TestTools_UploadFilesConcurrent(t *testing.T) {
+	pngData := testPNG(t)
+	var parts []testPart
+	for i := 0; i < 8; i++ {
+		parts = append(parts, testPart{field: fmt.Sprintf("file%d", i), fileName: fmt.Sprintf("%d.png", i), data: pngData})
+	}
+
+	var mu sync.Mutex
+	running, most := 0, 0
+	var testTools Tools
+	testTools.Storage = &MemoryStorage{}
+	testTools.UploadedFile.Concurrency = 3
+	testTools.Scanner = scanFunc(func(ctx context.Context, fileName string, r io.Reader) error {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+
+	files, err := testTools.UploadFiles(newMultipartRequest(t, parts...), "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if most < 2 || most > 3 {
+		t.Errorf("wrong number of files processed at once. wanted 2 to 3, got=%d", most)
+	}
+	if len(files) != len(parts) {
+		t.Fatalf("wrong number of files. wanted=%d, got=%d", len(parts), len(files))
+	}
+	for i, f := range files {
+		if f.OrigFileName != parts[i].fileName {
+			t.Errorf("wrong order. wanted %s at %d, got %s", parts[i].fileName, i, f.OrigFileName)
+		}
+	}
+}
+
+var concurrentCollisionTests = []struct {
+	name          string
+	policy        CollisionPolicy
+	errorExpected bool
+	expected      string
+}{
+	{name: "suffix", policy: CollisionSuffix, expected: "same-1.txt,same-2.txt,same-3.txt,same.txt"},
+	{name: "error", policy: CollisionError, errorExpected: true},
+}
+
+func TestTools_UploadFilesConcurrentCollision(t *testing.T) {
+	var parts []testPart
+	for i := 0; i < 4; i++ {
+		parts = append(parts, testPart{field: "file", fileName: "same.txt", data: []byte(fmt.Sprintf("file %d", i))})
+	}
+
+	for _, e := range concurrentCollisionTests {
+		store := &MemoryStorage{}
+		var testTools Tools
+		testTools.Storage = store
+		testTools.UploadedFile.Concurrency = 4
+		testTools.UploadedFile.OnCollision = e.policy
+
+		files, err := testTools.UploadFiles(newMultipartRequest(t, parts...), "uploads", false)
+		var exists *FileExistsError
+		if e.errorExpected {
+			if !errors.As(err, &exists) {
+				t.Errorf("%s: expected *FileExistsError, got %v", e.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+
+		var names []string
+		for _, f := range files {
+			names = append(names, f.NewFileName)
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != e.expected {
+			t.Errorf("%s: wrong names. wanted=%s, got=%v", e.name, e.expected, names)
+		}
+		if stored, _ := store.List(context.Background(), "uploads/"); len(stored) != len(parts) {
+			t.Errorf("%s: wrong number of files stored. wanted=%d, got=%d", e.name, len(parts), len(stored))
+		}
+	}
+}
+
+var collisionAcrossRequestsTests = []struct {
+	name          string
+	policy        CollisionPolicy
+	expectedFiles int
+	expectedErrs  int
+}{
+	{name: "suffix", policy: CollisionSuffix, expectedFiles: 2},
+	{name: "error", policy: CollisionError, expectedFiles: 1, expectedErrs: 1},
+}
+
+func TestTools_UploadFilesCollisionAcrossRequests(t *testing.T) {
+	for _, e := range collisionAcrossRequestsTests {
+		store := DiskStorage{Root: t.TempDir()}
+		var testTools Tools
+		testTools.Storage = store
+		testTools.UploadedFile.OnCollision = e.policy
+		testTools.UploadedFile.MaxFileSize = 1 << 20
+		// the scanner holds both files between choosing their name and storing them
+		testTools.Scanner = scanFunc(func(ctx context.Context, fileName string, r io.Reader) error {
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		})
+
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := newMultipartRequest(t, testPart{field: "file", fileName: "same.txt", data: []byte(fmt.Sprintf("request %d", i))})
+				_, errs[i] = testTools.UploadFiles(req, "uploads", false)
+			}()
+		}
+		wg.Wait()
+
+		failed := 0
+		for _, err := range errs {
+			var exists *FileExistsError
+			if errors.As(err, &exists) {
+				failed++
+			} else if err != nil {
+				t.Errorf("%s: %s", e.name, err)
+			}
+		}
+		if failed != e.expectedErrs {
+			t.Errorf("%s: wrong number of *FileExistsError. wanted=%d, got=%d", e.name, e.expectedErrs, failed)
+		}
+		stored, _ := store.List(context.Background(), "uploads/")
+		if len(stored) != e.expectedFiles {
+			t.Errorf("%s: wrong number of files stored. wanted=%d, got=%d", e.name, e.expectedFiles, len(stored))
+		}
+		for _, f := range stored {
+			if f.Size == 0 {
+				t.Errorf("%s: empty file left behind: %s", e.name, f.Key)
+			}
+		}
+	}
+}
+
+func TestTools_UploadFilesConcurrentCancel(t *testing.T) {
+	pngData := testPNG(t)
+	var testTools Tools
+	testTools.Storage = &MemoryStorage{}
+	testTools.UploadedFile.Concurrency = 2
+	testTools.UploadedFile.Transactional = true
+	testTools.Scanner = scanFunc(func(ctx context.Context, fileName string, r io.Reader) error {
+		if fileName == "bad.png" {
+			return &InfectedFileError{FileName: fileName, Threat: "Test-Signature"}
+		}
+		// the other files wait until the failure cancels them
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	})
+
+	req := newMultipartRequest(t,
+		testPart{field: "a", fileName: "slow.png", data: pngData},
+		testPart{field: "b", fileName: "bad.png", data: pngData},
+		testPart{field: "c", fileName: "never.png", data: pngData},
+	)
+	start := time.Now()
+	files, err := testTools.UploadFiles(req, "uploads")
+
+	var infected *InfectedFileError
+	if !errors.As(err, &infected) {
+		t.Fatalf("expected *InfectedFileError, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("expected the remaining files to be cancelled")
+	}
+	if len(files) != 0 {
+		t.Errorf("wrong number of files. wanted=0, got=%d", len(files))
+	}
+	list, _ := testTools.Storage.List(context.Background(), "uploads/")
+	if len(list) != 0 {
+		t.Errorf("files stored from a failed upload: %v", list)
+	}
+}
+
+var uploadContextTests = []struct {
+	name   string
+	stream bool
+}{
+	{name: "parsed", stream: false},
+	{name: "streamed", stream: true},
+}
+
+func TestTools_UploadFilesContext(t *testing.T) {
+	for _, e := range uploadContextTests {
+		uploadDir := t.TempDir()
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// the body is sent slowly, and the upload is cancelled halfway through the file
+		pr, pw := io.Pipe()
+		writer := multipart.NewWriter(pw)
+		go func() {
+			w, _ := writer.CreateFormFile("file", "big.txt")
+			chunk := bytes.Repeat([]byte("a"), 4096)
+			for i := 0; i < 256; i++ {
+				if i == 16 {
+					cancel()
+				}
+				if _, err := w.Write(chunk); err != nil {
+					return
+				}
+			}
+			_ = writer.Close()
+			_ = pw.Close()
+		}()
+
+		req := httptest.NewRequest("POST", "/", pr)
+		req.Header.Add("Content-Type", writer.FormDataContentType())
+
+		var testTools Tools
+		testTools.UploadedFile.Stream = e.stream
+		_, err := testTools.UploadFilesContext(ctx, req, uploadDir)
+		_ = pr.Close()
+		cancel()
+
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: expected context.Canceled, got %v", e.name, err)
+		}
+		// the partial file has been removed
+		entries, _ := os.ReadDir(uploadDir)
+		if len(entries) != 0 {
+			t.Errorf("%s: files left behind by a cancelled upload: %d", e.name, len(entries))
+		}
+	}
+}
+
 func TestTools_MakeDirIfNotExists(t *testing.T) {
 	var testTool Tools
 
@@ -214,6 +875,27 @@ func TestTools_MakeDirIfNotExists(t *testing.T) {
 	os.Remove("./testdata/myDir")
 }
 
+func TestTools_CleanDirectoryContext(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var testTools Tools
+	if err := testTools.CleanDirectoryContext(ctx, dir); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("wrong number of files left. wanted=2, got=%d", len(entries))
+	}
+}
+
 var slugTests = []struct {
 	name          string
 	s             string
@@ -266,6 +948,199 @@ func TestTools_DownloadStaticFile(t *testing.T) {
 	}
 }
 
+var downloadFSTests = []struct {
+	name           string
+	fsys           string
+	file           string
+	headers        map[string]string
+	expectedStatus int
+	expectedBody   string
+}{
+	{name: "whole file", fsys: "map", file: "reports/q1.txt", expectedStatus: http.StatusOK, expectedBody: "quarterly report"},
+	{name: "range", fsys: "map", file: "reports/q1.txt", headers: map[string]string{"Range": "bytes=10-15"}, expectedStatus: http.StatusPartialContent, expectedBody: "report"},
+	{name: "not modified", fsys: "map", file: "reports/q1.txt", headers: map[string]string{"If-Modified-Since": "Sat, 01 Jun 2024 12:00:00 GMT"}, expectedStatus: http.StatusNotModified},
+	{name: "missing", fsys: "map", file: "reports/q2.txt", expectedStatus: http.StatusNotFound},
+	{name: "directory", fsys: "map", file: "reports", expectedStatus: http.StatusNotFound},
+	{name: "invalid path", fsys: "map", file: "../reports/q1.txt", expectedStatus: http.StatusNotFound},
+	{name: "zip", fsys: "zip", file: "reports/q1.txt", expectedStatus: http.StatusOK, expectedBody: "quarterly report"},
+	{name: "zip range", fsys: "zip", file: "reports/q1.txt", headers: map[string]string{"Range": "bytes=10-15"}, expectedStatus: http.StatusPartialContent, expectedBody: "report"},
+	{name: "large zip range", fsys: "zip", file: "reports/all.txt", headers: map[string]string{"Range": "bytes=4-7"}, expectedStatus: http.StatusPartialContent, expectedBody: "abcd"},
+	{name: "zip not modified", fsys: "zip", file: "reports/q1.txt", headers: map[string]string{"If-Modified-Since": "Sat, 01 Jun 2024 12:00:00 GMT"}, expectedStatus: http.StatusNotModified},
+}
+
+func TestTools_DownloadFromFS(t *testing.T) {
+	modTime := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	mapFS := fstest.MapFS{"reports/q1.txt": {Data: []byte("quarterly report"), ModTime: modTime}}
+
+	var zipData bytes.Buffer
+	zw := zip.NewWriter(&zipData)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "reports/q1.txt", Method: zip.Deflate, Modified: modTime})
+	_, _ = w.Write([]byte("quarterly report"))
+	// too large to be buffered in memory
+	w, _ = zw.CreateHeader(&zip.FileHeader{Name: "reports/all.txt", Method: zip.Deflate, Modified: modTime})
+	_, _ = w.Write([]byte(strings.Repeat("abcd", maxBufferedDownload)))
+	_ = zw.Close()
+	zipFS, err := zip.NewReader(bytes.NewReader(zipData.Bytes()), int64(zipData.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	for _, e := range downloadFSTests {
+		var fsys fs.FS = mapFS
+		if e.fsys == "zip" {
+			fsys = zipFS
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		for k, v := range e.headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		testTools.DownloadFromFS(rr, req, fsys, e.file, "report.txt")
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status code. wanted=%d, got=%d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if e.expectedBody != "" && rr.Body.String() != e.expectedBody {
+			t.Errorf("%s: wrong body. wanted=%q, got=%q", e.name, e.expectedBody, rr.Body.String())
+		}
+		if rr.Code == http.StatusOK && rr.Header().Get("Content-Disposition") != "attachment; filename=\"report.txt\"" {
+			t.Errorf("%s: wrong content disposition: %s", e.name, rr.Header().Get("Content-Disposition"))
+		}
+	}
+}
+
+// countingFS counts the bytes read from the files it opens, which can only be read in order.
+type countingFS struct {
+	fs.FS
+	n int64
+}
+
+type countingFile struct {
+	fs.File
+	fsys *countingFS
+}
+
+func (f countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.fsys.n += int64(n)
+	return n, err
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return countingFile{File: f, fsys: c}, nil
+}
+
+var downloadFSStreamedTests = []struct {
+	name           string
+	method         string
+	headers        map[string]string
+	expectedStatus int
+	expectedRead   int64
+}{
+	{name: "head", method: "HEAD", expectedStatus: http.StatusOK},
+	{name: "not modified", method: "GET", headers: map[string]string{"If-Modified-Since": "Sat, 01 Jun 2024 12:00:00 GMT"}, expectedStatus: http.StatusNotModified},
+	{name: "whole file", method: "GET", expectedStatus: http.StatusOK, expectedRead: 4 * maxBufferedDownload},
+	{name: "range", method: "GET", headers: map[string]string{"Range": "bytes=4-7"}, expectedStatus: http.StatusPartialContent, expectedRead: 4 * maxBufferedDownload},
+}
+
+func TestTools_DownloadFromFSStreamed(t *testing.T) {
+	modTime := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	data := strings.Repeat("abcd", maxBufferedDownload)
+	fsys := &countingFS{FS: fstest.MapFS{"all.txt": {Data: []byte(data), ModTime: modTime}}}
+
+	var testTools Tools
+	for _, e := range downloadFSStreamedTests {
+		fsys.n = 0
+		req := httptest.NewRequest(e.method, "/", nil)
+		for k, v := range e.headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		testTools.DownloadFromFS(rr, req, fsys, "all.txt", "all.txt")
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status code. wanted=%d, got=%d", e.name, e.expectedStatus, rr.Code)
+		}
+		// only a range request is buffered, anything else reads no more than it sends
+		if fsys.n != e.expectedRead {
+			t.Errorf("%s: wrong number of bytes read. wanted=%d, got=%d", e.name, e.expectedRead, fsys.n)
+		}
+		if e.method == "HEAD" && rr.Header().Get("Content-Length") != strconv.Itoa(len(data)) {
+			t.Errorf("%s: wrong content length: %s", e.name, rr.Header().Get("Content-Length"))
+		}
+	}
+}
+
+var confinedDownloadTests = []struct {
+	name           string
+	pathName       string
+	allowDotFiles  bool
+	expectedStatus int
+}{
+	{name: "file", pathName: "report.txt", expectedStatus: http.StatusOK},
+	{name: "nested file", pathName: "sub/doc.txt", expectedStatus: http.StatusOK},
+	{name: "link inside root", pathName: "inner.txt", expectedStatus: http.StatusOK},
+	{name: "parent", pathName: "../secret.txt", expectedStatus: http.StatusNotFound},
+	{name: "deep traversal", pathName: "../../../../../../etc/passwd", expectedStatus: http.StatusNotFound},
+	{name: "absolute", pathName: "/etc/passwd", expectedStatus: http.StatusNotFound},
+	{name: "backslashes", pathName: `..\secret.txt`, expectedStatus: http.StatusNotFound},
+	{name: "traversal after directory", pathName: "sub/../../secret.txt", expectedStatus: http.StatusNotFound},
+	{name: "encoded dots", pathName: "%2e%2e/secret.txt", expectedStatus: http.StatusNotFound},
+	{name: "null byte", pathName: "report.txt\x00.png", expectedStatus: http.StatusNotFound},
+	{name: "link outside root", pathName: "link.txt", expectedStatus: http.StatusNotFound},
+	{name: "root itself", pathName: ".", expectedStatus: http.StatusNotFound},
+	{name: "dotfile", pathName: ".env", expectedStatus: http.StatusNotFound},
+	{name: "dot directory", pathName: ".git/config", expectedStatus: http.StatusNotFound},
+	{name: "link to dotfile", pathName: "hidden.txt", expectedStatus: http.StatusNotFound},
+	{name: "dotfile allowed", pathName: ".env", allowDotFiles: true, expectedStatus: http.StatusOK},
+}
+
+func TestTools_DownloadStaticFileConfined(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "public")
+	for name, content := range map[string]string{
+		"secret.txt":         "outside",
+		"public/report.txt":  "report",
+		"public/sub/doc.txt": "doc",
+		"public/.env":        "SECRET=1",
+		"public/.git/config": "[core]",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"link.txt": "../secret.txt", "inner.txt": "sub/doc.txt", "hidden.txt": ".env"} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skip("symbolic links not supported:", err)
+		}
+	}
+
+	// DiskStorage works as a value or a pointer, and the links are checked either way
+	for _, store := range []Storage{nil, DiskStorage{}, &DiskStorage{}} {
+		for _, e := range confinedDownloadTests {
+			testTools := Tools{Storage: store, DownloadRoot: root, AllowDotFiles: e.allowDotFiles}
+			rr := httptest.NewRecorder()
+			testTools.DownloadStaticFile(rr, httptest.NewRequest("GET", "/", nil), e.pathName, "download.txt")
+			if rr.Code != e.expectedStatus {
+				t.Errorf("%s (%T): wrong status code. wanted=%d, got=%d", e.name, store, e.expectedStatus, rr.Code)
+			}
+			if rr.Code == http.StatusNotFound && strings.Contains(rr.Body.String(), "outside") {
+				t.Errorf("%s (%T): served a file outside the root", e.name, store)
+			}
+		}
+	}
+}
+
 var jsonTests = []struct {
 	name          string
 	json          string
@@ -286,6 +1161,175 @@ var jsonTests = []struct {
 	{name: "not json", json: `foo bar`, errorExpected: true, maxSize: 1024, allowUnknown: true},
 }
 
+var downloadOptionsTests = []struct {
+	name                string
+	file                string
+	displayName         string
+	opts                []DownloadOptions
+	expectedType        string
+	expectedDisposition string
+	expectedCSP         string
+}{
+	{name: "default", file: "photo.png", displayName: "photo.png", expectedType: "application/octet-stream", expectedDisposition: "attachment; filename=\"photo.png\""},
+	{name: "extension", file: "photo.png", displayName: "photo.png", opts: []DownloadOptions{{DetectContentType: true}}, expectedType: "image/png", expectedDisposition: "attachment; filename=\"photo.png\""},
+	{name: "display name extension", file: "blobs/1234", displayName: "notes.txt", opts: []DownloadOptions{{DetectContentType: true}}, expectedType: "text/plain; charset=utf-8", expectedDisposition: "attachment; filename=\"notes.txt\""},
+	{name: "sniffed", file: "blobs/5678", displayName: "photo", opts: []DownloadOptions{{DetectContentType: true}}, expectedType: "image/png", expectedDisposition: "attachment; filename=\"photo\""},
+	{name: "inline", file: "photo.png", displayName: "photo.png", opts: []DownloadOptions{{DetectContentType: true, Inline: true}}, expectedType: "image/png", expectedDisposition: "inline; filename=\"photo.png\""},
+	{name: "csp", file: "page.html", displayName: "page.html", opts: []DownloadOptions{{DetectContentType: true, Inline: true, ContentSecurityPolicy: SandboxCSP}}, expectedType: "text/html; charset=utf-8", expectedDisposition: "inline; filename=\"page.html\"", expectedCSP: SandboxCSP},
+}
+
+func TestTools_DownloadOptions(t *testing.T) {
+	pngData := testPNG(t)
+	fsys := fstest.MapFS{
+		"photo.png":  {Data: pngData},
+		"blobs/1234": {Data: []byte("some notes")},
+		"blobs/5678": {Data: pngData},
+		"page.html":  {Data: []byte("<script>alert(1)</script>")},
+	}
+
+	var testTools Tools
+	for _, e := range downloadOptionsTests {
+		rr := httptest.NewRecorder()
+		testTools.DownloadFromFS(rr, httptest.NewRequest("GET", "/", nil), fsys, e.file, e.displayName, e.opts...)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: wrong status code. wanted=200, got=%d", e.name, rr.Code)
+			continue
+		}
+		if got := rr.Header().Get("Content-Type"); got != e.expectedType {
+			t.Errorf("%s: wrong content type. wanted=%s, got=%s", e.name, e.expectedType, got)
+		}
+		if got := rr.Header().Get("Content-Disposition"); got != e.expectedDisposition {
+			t.Errorf("%s: wrong content disposition. wanted=%s, got=%s", e.name, e.expectedDisposition, got)
+		}
+		if got := rr.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("%s: wrong X-Content-Type-Options. wanted=nosniff, got=%s", e.name, got)
+		}
+		if got := rr.Header().Get("Content-Security-Policy"); got != e.expectedCSP {
+			t.Errorf("%s: wrong content security policy. wanted=%s, got=%s", e.name, e.expectedCSP, got)
+		}
+		// sniffing must not eat into the file
+		if !bytes.Equal(rr.Body.Bytes(), fsys[e.file].Data) {
+			t.Errorf("%s: wrong body, %d bytes", e.name, rr.Body.Len())
+		}
+	}
+}
+
+var downloadZipTests = []struct {
+	name           string
+	entries        []ZipEntry
+	expectedStatus int
+	expectedNames  string
+}{
+	{name: "files", entries: []ZipEntry{{Path: "a.txt", Name: "first.txt"}, {Path: "sub/b.txt"}}, expectedStatus: http.StatusOK, expectedNames: "first.txt,b.txt"},
+	{name: "folders", entries: []ZipEntry{{Path: "a.txt", Name: "docs/a.txt"}}, expectedStatus: http.StatusOK, expectedNames: "docs/a.txt"},
+	{name: "duplicates", entries: []ZipEntry{{Path: "a.txt", Name: "same.txt"}, {Path: "sub/b.txt", Name: "Same.txt"}}, expectedStatus: http.StatusOK, expectedNames: "same.txt,Same (2).txt"},
+	{name: "unsafe names", entries: []ZipEntry{{Path: "a.txt", Name: "../../etc/cron.d/x"}, {Path: "sub/b.txt", Name: `C:\evil\b.txt`}}, expectedStatus: http.StatusOK, expectedNames: "etc/cron.d/x,C_/evil/b.txt"},
+	{name: "missing", entries: []ZipEntry{{Path: "a.txt"}, {Path: "c.txt"}}, expectedStatus: http.StatusNotFound},
+	{name: "traversal", entries: []ZipEntry{{Path: "a.txt"}, {Path: "../secret.txt"}}, expectedStatus: http.StatusNotFound},
+	{name: "dotfile", entries: []ZipEntry{{Path: ".env"}}, expectedStatus: http.StatusNotFound},
+}
+
+func TestTools_DownloadZip(t *testing.T) {
+	store := &MemoryStorage{}
+	contents := map[string]string{
+		"files/a.txt":     "first file",
+		"files/sub/b.txt": "second file",
+		"files/.env":      "SECRET=1",
+		"secret.txt":      "not for you",
+	}
+	for key, data := range contents {
+		if _, err := store.Put(context.Background(), key, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testTools := Tools{Storage: store, DownloadRoot: "files"}
+
+	for _, e := range downloadZipTests {
+		rr := httptest.NewRecorder()
+		err := testTools.DownloadZip(rr, httptest.NewRequest("GET", "/", nil), e.entries, "attachments.zip")
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status code. wanted=%d, got=%d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+		if e.expectedStatus != http.StatusOK {
+			if err == nil {
+				t.Errorf("%s: expected an error", e.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+		if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="attachments.zip"` {
+			t.Errorf("%s: wrong content disposition: %s", e.name, got)
+		}
+		if got := rr.Header().Get("Content-Type"); got != "application/zip" {
+			t.Errorf("%s: wrong content type: %s", e.name, got)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+		var names []string
+		for i, f := range zr.File {
+			names = append(names, f.Name)
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(rc)
+			rc.Close()
+			expected := contents["files/"+e.entries[i].Path]
+			if string(data) != expected {
+				t.Errorf("%s: wrong content of %s. wanted=%q, got=%q", e.name, f.Name, expected, data)
+			}
+		}
+		if strings.Join(names, ",") != e.expectedNames {
+			t.Errorf("%s: wrong names. wanted=%s, got=%s", e.name, e.expectedNames, strings.Join(names, ","))
+		}
+	}
+}
+
+// cancelWriter cancels a request once the response has started.
+type cancelWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestTools_DownloadZipDisconnect(t *testing.T) {
+	store := &MemoryStorage{}
+	testTools := Tools{Storage: store}
+	// random text does not compress to nothing, so the archive is written as it goes
+	for _, key := range []string{"a.txt", "b.txt", "c.txt"} {
+		if _, err := store.Put(context.Background(), key, strings.NewReader(testTools.RandomString(100000))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	rr := &cancelWriter{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+
+	err := testTools.DownloadZip(rr, req, []ZipEntry{{Path: "a.txt"}, {Path: "b.txt"}, {Path: "c.txt"}}, "all.zip")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if rr.Body.Len() >= 300000 {
+		t.Errorf("expected the archive to stop early, got %d bytes", rr.Body.Len())
+	}
+}
+
 func TestTools_ReadJSON(t *testing.T) {
 	var testTool Tools
 
@@ -363,3 +1407,29 @@ func TestTools_ErrorJSON(t *testing.T) {
 		t.Errorf("wrong status code returned; wanted=503, got=%d", rr.Code)
 	}
 }
+
+var contentDispositionTests = []struct {
+	name        string
+	disposition string
+	fileName    string
+	expected    string
+}{
+	{name: "plain", disposition: "attachment", fileName: "report.pdf", expected: `attachment; filename="report.pdf"`},
+	{name: "inline", disposition: "inline", fileName: "photo.png", expected: `inline; filename="photo.png"`},
+	{name: "unknown disposition", disposition: "form-data", fileName: "a.txt", expected: `attachment; filename="a.txt"`},
+	{name: "quotes", disposition: "attachment", fileName: `my "best" \ file.txt`, expected: `attachment; filename="my \"best\" \\ file.txt"`},
+	{name: "header injection", disposition: "attachment", fileName: "a.txt\r\nSet-Cookie: x=1", expected: `attachment; filename="a.txtSet-Cookie: x=1"`},
+	{name: "accents", disposition: "attachment", fileName: "Résumé 2024.pdf", expected: `attachment; filename="Resume 2024.pdf"; filename*=UTF-8''R%C3%A9sum%C3%A9%202024.pdf`},
+	{name: "decomposed", disposition: "attachment", fileName: "Re\u0301sume\u0301.pdf", expected: `attachment; filename="Resume.pdf"; filename*=UTF-8''R%C3%A9sum%C3%A9.pdf`},
+	{name: "japanese", disposition: "inline", fileName: "報告書.pdf", expected: `inline; filename="___.pdf"; filename*=UTF-8''%E5%A0%B1%E5%91%8A%E6%9B%B8.pdf`},
+}
+
+func TestTools_ContentDisposition(t *testing.T) {
+	var testTools Tools
+	for _, e := range contentDispositionTests {
+		got := testTools.ContentDisposition(e.disposition, e.fileName)
+		if got != e.expected {
+			t.Errorf("%s: wrong content disposition. wanted=%s, got=%s", e.name, e.expected, got)
+		}
+	}
+}
@@ -0,0 +1,622 @@
+package toolbox
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TusVersion is the version of the tus resumable upload protocol implemented by TusHandler.
+const TusVersion = "1.0.0"
+
+// tusIDLength is the length of the hex encoded upload IDs handed out by TusHandler.
+const tusIDLength = 32
+
+// TusHandler is an http.Handler implementing the tus resumable upload protocol 1.0
+// (https://tus.io/protocols/resumable-upload) with the creation, creation-with-upload,
+// termination and expiration extensions. It lets clients on unreliable networks send a
+// file in as many requests as they need, picking up where they left off.
+//
+// Uploads in progress are kept in PartialDir on the local disk. Once all bytes have arrived,
+// the file goes through the same checks as UploadFiles (allowed types, size limits, file name
+// and extension rules) and is saved to UploadDir through Tools.Storage. The zero value is not
+// usable; at least Tools, PartialDir and BasePath must be set.
+type TusHandler struct {
+	// Tools provides the upload rules in Tools.UploadedFile and the storage for completed files.
+	Tools *Tools
+	// BasePath is the URL path the handler is mounted at, such as "/files/". Upload URLs are
+	// BasePath followed by the upload ID.
+	BasePath string
+	// PartialDir is a local directory where uploads are kept until they are complete.
+	PartialDir string
+	// UploadDir is the directory, or key prefix, completed uploads are saved to.
+	UploadDir string
+	// KeepFileName saves completed uploads under the file name sent in the upload metadata
+	// instead of a random name.
+	KeepFileName bool
+	// Expiration is how long an upload is kept after it was last written to. Once it is
+	// complete, only its state is kept, for clients asking about it. It defaults to 24 hours.
+	Expiration time.Duration
+	// OnComplete is called after an upload has been saved.
+	OnComplete func(r *http.Request, f *UploadedFile)
+
+	locks sync.Map
+	// now is replaced in tests to move the clock forward
+	now func() time.Time
+}
+
+// tusInfo is the state of an upload, saved next to its data as JSON.
+type tusInfo struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// RawMetadata is the Upload-Metadata header as it was sent, returned on HEAD requests.
+	RawMetadata string    `json:"raw_metadata,omitempty"`
+	Expires     time.Time `json:"expires"`
+	// TypeChecked is set once enough bytes have arrived to check the file type.
+	TypeChecked bool `json:"type_checked,omitempty"`
+	// File is set once the upload is complete and has been saved.
+	File *UploadedFile `json:"file,omitempty"`
+}
+
+func (h *TusHandler) clock() time.Time {
+	if h.now != nil {
+		return h.now()
+	}
+	return time.Now()
+}
+
+func (h *TusHandler) expiration() time.Duration {
+	if h.Expiration > 0 {
+		return h.Expiration
+	}
+	return 24 * time.Hour
+}
+
+func (h *TusHandler) maxSize() int64 {
+	if h.Tools.UploadedFile.MaxFileSize > 0 {
+		return int64(h.Tools.UploadedFile.MaxFileSize)
+	}
+	return 1024 * 1024 * 1024
+}
+
+func (h *TusHandler) dataPath(id string) string {
+	return filepath.Join(h.PartialDir, id)
+}
+
+func (h *TusHandler) infoPath(id string) string {
+	return filepath.Join(h.PartialDir, id+".info")
+}
+
+// ServeHTTP routes the tus requests: OPTIONS for discovery, POST to create an upload, and
+// HEAD, PATCH and DELETE on an upload URL.
+func (h *TusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+
+	// browsers can only send GET and POST, so the method may be overridden
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && r.Method == http.MethodPost {
+		r.Method = override
+	}
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", TusVersion)
+		w.Header().Set("Tus-Extension", "creation,creation-with-upload,termination,expiration")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.maxSize(), 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != TusVersion {
+		w.Header().Set("Tus-Version", TusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, h.BasePath), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "OPTIONS, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		h.create(w, r)
+		return
+	}
+	if !validTusID(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		h.head(w, r, id)
+	case http.MethodPatch:
+		h.patch(w, r, id)
+	case http.MethodDelete:
+		h.terminate(w, r, id)
+	default:
+		w.Header().Set("Allow", "OPTIONS, HEAD, PATCH, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// validTusID keeps anything that is not an ID handed out by create, such as "../x", from
+// being used to build a file path.
+func validTusID(id string) bool {
+	if len(id) != tusIDLength {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (h *TusHandler) create(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "deferred upload length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > h.maxSize() {
+		writeTusError(w, &FileTooLargeError{Limit: h.maxSize(), Size: length})
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := randomID()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	info := &tusInfo{
+		ID:          id,
+		Length:      length,
+		Metadata:    metadata,
+		RawMetadata: r.Header.Get("Upload-Metadata"),
+		Expires:     h.clock().Add(h.expiration()),
+	}
+
+	if err := os.MkdirAll(h.PartialDir, 0755); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	data, err := os.OpenFile(h.dataPath(info.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	data.Close()
+	if err := h.saveInfo(info); err != nil {
+		h.remove(info.ID)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", strings.TrimRight(h.BasePath, "/")+"/"+info.ID)
+	w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+
+	// creation-with-upload: the first chunk may come with the creation request
+	if r.Header.Get("Content-Type") == "application/offset+octet-stream" {
+		r.Header.Set("Upload-Offset", "0")
+		h.write(w, r, info, http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *TusHandler) head(w http.ResponseWriter, r *http.Request, id string) {
+	info, offset, ok := h.load(w, id, false)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	if info.RawMetadata != "" {
+		w.Header().Set("Upload-Metadata", info.RawMetadata)
+	}
+	if info.File == nil {
+		w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *TusHandler) patch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	mu := h.tryLock(id)
+	if mu == nil {
+		http.Error(w, "upload is already being written to", http.StatusLocked)
+		return
+	}
+	defer h.unlock(id, mu)
+
+	info, _, ok := h.load(w, id, true)
+	if !ok {
+		return
+	}
+	h.write(w, r, info, http.StatusNoContent)
+}
+
+// tryLock takes the lock of upload id, so only one request at a time writes to or removes
+// it. It returns nil when the lock is held by another request.
+func (h *TusHandler) tryLock(id string) *sync.Mutex {
+	lock, _ := h.locks.LoadOrStore(id, &sync.Mutex{})
+	mu := lock.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil
+	}
+	return mu
+}
+
+// unlock releases the lock of upload id, forgetting it when the upload does not exist, so
+// requests for unknown or removed uploads leave nothing behind.
+func (h *TusHandler) unlock(id string, mu *sync.Mutex) {
+	if _, err := os.Stat(h.infoPath(id)); os.IsNotExist(err) {
+		h.locks.Delete(id)
+	}
+	mu.Unlock()
+}
+
+// write appends the request body to the upload, checks the file type once enough bytes are
+// in, and saves the file when it is complete. Whatever was received before the client went
+// away is kept, so the upload can be resumed from there.
+func (h *TusHandler) write(w http.ResponseWriter, r *http.Request, info *tusInfo, status int) {
+	if info.File != nil {
+		http.Error(w, "upload is already complete", http.StatusForbidden)
+		return
+	}
+
+	data, err := os.OpenFile(h.dataPath(info.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer data.Close()
+	stat, err := data.Stat()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	offset := stat.Size()
+
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if clientOffset != offset {
+		http.Error(w, "Upload-Offset does not match the upload", http.StatusConflict)
+		return
+	}
+
+	// never take more than the declared length
+	remaining := info.Length - offset
+	n, copyErr := io.Copy(data, io.LimitReader(r.Body, remaining))
+	offset += n
+	if copyErr == nil && n == remaining {
+		// anything left in the body goes past the end of the upload
+		var extra [1]byte
+		if m, _ := r.Body.Read(extra[:]); m > 0 {
+			copyErr = errors.New("request body is longer than the upload")
+		}
+	}
+
+	info.Expires = h.clock().Add(h.expiration())
+	if !info.TypeChecked && (offset >= sniffLen || offset == info.Length) {
+		if err := h.checkType(info); err != nil {
+			h.remove(info.ID)
+			writeTusError(w, err)
+			return
+		}
+		info.TypeChecked = true
+	}
+
+	if offset == info.Length {
+		data.Close()
+		if err := h.complete(r, info); err != nil {
+			// a file breaking the upload rules is thrown away, but after any other error, such
+			// as an unreachable scanner or storage, the last PATCH can be sent again
+			if rejectsFile(err) {
+				h.remove(info.ID)
+			} else {
+				_ = h.saveInfo(info)
+			}
+			writeTusError(w, err)
+			return
+		}
+		// nothing writes to a completed upload, so its lock is not needed anymore
+		h.locks.Delete(info.ID)
+	}
+	if err := h.saveInfo(info); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if info.File == nil {
+		w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+	}
+	if copyErr != nil {
+		http.Error(w, copyErr.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// checkType detects the type of the upload from its first bytes and compares it with
+// UploadedFile.AllowedFileTypes, so a disallowed file is refused long before it is complete.
+func (h *TusHandler) checkType(info *tusInfo) error {
+	data, err := os.Open(h.dataPath(info.ID))
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	buffer := make([]byte, sniffLen)
+	n, err := io.ReadFull(data, buffer)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if fileType := h.Tools.fileTypes().Detect(buffer[:n]); !h.Tools.isAllowedFileType(fileType) {
+		h.Tools.emit(UploadEvent{Type: UploadRejected, FileName: info.Metadata["filename"], Size: info.Length, Written: int64(n), Err: errFileTypeNotPermitted})
+		return errFileTypeNotPermitted
+	}
+	return nil
+}
+
+// complete saves a finished upload through Tools, the same way UploadFiles saves a file,
+// and removes its partial data. All of it has arrived by then, so saving goes on when the
+// client disconnects.
+func (h *TusHandler) complete(r *http.Request, info *tusInfo) error {
+	data, err := os.Open(h.dataPath(info.ID))
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	fileName := info.Metadata["filename"]
+	if fileName == "" {
+		fileName = info.Metadata["name"]
+	}
+	if fileName == "" {
+		fileName = info.ID
+	}
+
+	state := &uploadState{maxFileSize: h.maxSize()}
+	if h.Tools.Uploader != nil {
+		state.uploader = h.Tools.Uploader(r)
+	}
+	file, err := h.Tools.saveUploadedFile(context.WithoutCancel(r.Context()), state, data, "", fileName, info.Length, h.UploadDir, !h.KeepFileName)
+	if err != nil {
+		return err
+	}
+	info.File = file
+
+	data.Close()
+	_ = os.Remove(h.dataPath(info.ID))
+	if h.OnComplete != nil {
+		h.OnComplete(r, file)
+	}
+	return nil
+}
+
+func (h *TusHandler) terminate(w http.ResponseWriter, r *http.Request, id string) {
+	// a PATCH in progress would otherwise write the state of the upload back once it is gone
+	mu := h.tryLock(id)
+	if mu == nil {
+		http.Error(w, "upload is being written to", http.StatusLocked)
+		return
+	}
+	defer h.unlock(id, mu)
+
+	if _, _, ok := h.load(w, id, true); !ok {
+		return
+	}
+	h.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// load reads the state of upload id along with its current offset. When the upload does not
+// exist or has expired, it writes the response and returns false. locked tells whether the
+// caller holds the lock of the upload; otherwise an expired upload is only removed when no
+// other request holds it.
+func (h *TusHandler) load(w http.ResponseWriter, id string, locked bool) (*tusInfo, int64, bool) {
+	info, err := h.readInfo(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "upload not found", http.StatusNotFound)
+		} else {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return nil, 0, false
+	}
+
+	if h.clock().After(info.Expires) {
+		if locked {
+			h.remove(id)
+		} else {
+			h.removeExpired(id, func() { h.remove(id) })
+		}
+		http.Error(w, "upload has expired", http.StatusGone)
+		return nil, 0, false
+	}
+	if info.File != nil {
+		return info, info.Length, true
+	}
+
+	stat, err := os.Stat(h.dataPath(id))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, 0, false
+	}
+	return info, stat.Size(), true
+}
+
+// readInfo reads the saved state of upload id.
+func (h *TusHandler) readInfo(id string) (*tusInfo, error) {
+	raw, err := os.ReadFile(h.infoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var info tusInfo
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (h *TusHandler) saveInfo(info *tusInfo) error {
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	// write the new state next to the old one and swap them, so a crash never leaves
+	// a half written info file
+	tmp := h.infoPath(info.ID) + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.infoPath(info.ID))
+}
+
+// remove deletes the data and state of upload id.
+func (h *TusHandler) remove(id string) {
+	_ = os.Remove(h.dataPath(id))
+	_ = os.Remove(h.infoPath(id))
+	h.locks.Delete(id)
+}
+
+// RemoveExpired deletes every upload whose expiration time has passed, whether unfinished or
+// the state left of a completed one, and returns how many were removed. Expired uploads are
+// also removed when a client asks for them, but this catches those that are never asked about
+// again. Uploads being written to are skipped.
+func (h *TusHandler) RemoveExpired() (int, error) {
+	expired, err := h.expiredUploads()
+	removed := 0
+	for _, info := range expired {
+		if h.removeExpired(info.ID, func() { h.remove(info.ID) }) {
+			removed++
+		}
+	}
+	return removed, err
+}
+
+// removeExpired calls remove when upload id is still expired once its lock is held, and
+// reports whether it did. An upload being written to is left alone, as writing to it moves
+// its expiration time forward.
+func (h *TusHandler) removeExpired(id string, remove func()) bool {
+	mu := h.tryLock(id)
+	if mu == nil {
+		return false
+	}
+	defer h.unlock(id, mu)
+
+	info, err := h.readInfo(id)
+	if err != nil || !h.clock().After(info.Expires) {
+		return false
+	}
+	remove()
+	return true
+}
+
+// expiredUploads returns the uploads whose expiration time has passed.
+func (h *TusHandler) expiredUploads() ([]tusInfo, error) {
+	entries, err := os.ReadDir(h.PartialDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []tusInfo
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".info")
+		if !ok || !validTusID(id) {
+			continue
+		}
+		info, err := h.readInfo(id)
+		if err != nil {
+			continue
+		}
+		if h.clock().After(info.Expires) {
+			expired = append(expired, *info)
+		}
+	}
+	return expired, nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs of a key and
+// a base64 encoded value, the value being optional.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", key)
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
+
+// rejectsFile reports whether err, from saving a completed upload, is about the file itself,
+// such as its type or size, so sending it again can not succeed.
+func rejectsFile(err error) bool {
+	var tooLarge *FileTooLargeError
+	var requestTooLarge *RequestTooLargeError
+	var mismatch *ExtensionMismatchError
+	var infected *InfectedFileError
+	var imageTooLarge *ImageTooLargeError
+	return errors.Is(err, errFileTypeNotPermitted) || errors.As(err, &tooLarge) || errors.As(err, &requestTooLarge) ||
+		errors.As(err, &mismatch) || errors.As(err, &infected) || errors.As(err, &imageTooLarge)
+}
+
+// writeTusError responds with the status matching an error from the upload checks.
+func writeTusError(w http.ResponseWriter, err error) {
+	var tooLarge *FileTooLargeError
+	var requestTooLarge *RequestTooLargeError
+	var mismatch *ExtensionMismatchError
+	var infected *InfectedFileError
+	var imageTooLarge *ImageTooLargeError
+	switch {
+	case errors.As(err, &tooLarge), errors.As(err, &requestTooLarge), errors.As(err, &imageTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errFileTypeNotPermitted), errors.As(err, &mismatch):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.As(err, &infected):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
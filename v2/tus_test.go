@@ -0,0 +1,402 @@
+package toolbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tusRequest sends a tus request to the test server and returns the response with its body read.
+func tusRequest(t *testing.T, method, url string, headers map[string]string, body []byte) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", TusVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+	return res, string(data)
+}
+
+func newTusServer(t *testing.T, h *TusHandler) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/files/", h)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestTusHandler(t *testing.T) {
+	pngData := testPNG(t)
+	var store MemoryStorage
+	testTools := Tools{Storage: &store}
+	testTools.UploadedFile.AllowedFileTypes = []string{"image/png"}
+
+	var completed *UploadedFile
+	h := &TusHandler{
+		Tools:      &testTools,
+		BasePath:   "/files/",
+		PartialDir: t.TempDir(),
+		UploadDir:  "uploads",
+		OnComplete: func(r *http.Request, f *UploadedFile) { completed = f },
+	}
+	srv := newTusServer(t, h)
+
+	res, _ := tusRequest(t, http.MethodOptions, srv.URL+"/files/", nil, nil)
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("Tus-Version") != TusVersion {
+		t.Fatalf("wrong discovery response. status=%d, version=%s", res.StatusCode, res.Header.Get("Tus-Version"))
+	}
+
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("photo.png"))
+	res, _ = tusRequest(t, http.MethodPost, srv.URL+"/files/", map[string]string{
+		"Upload-Length":   strconv.Itoa(len(pngData)),
+		"Upload-Metadata": metadata,
+	}, nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("wrong status code for creation. wanted=201, got=%d", res.StatusCode)
+	}
+	location := srv.URL + res.Header.Get("Location")
+
+	// send the first half, then pretend the connection dropped and ask where to resume
+	half := len(pngData) / 2
+	patch := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+	res, _ = tusRequest(t, http.MethodPatch, location, patch, pngData[:half])
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("wrong status code for first chunk. wanted=204, got=%d", res.StatusCode)
+	}
+
+	res, _ = tusRequest(t, http.MethodHead, location, nil, nil)
+	if res.Header.Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Errorf("wrong offset. wanted=%d, got=%s", half, res.Header.Get("Upload-Offset"))
+	}
+	if res.Header.Get("Upload-Metadata") != metadata {
+		t.Errorf("wrong metadata returned: %s", res.Header.Get("Upload-Metadata"))
+	}
+
+	// a chunk sent for the wrong offset is refused
+	res, _ = tusRequest(t, http.MethodPatch, location, patch, pngData[half:])
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("wrong status code for offset mismatch. wanted=409, got=%d", res.StatusCode)
+	}
+
+	patch["Upload-Offset"] = strconv.Itoa(half)
+	res, _ = tusRequest(t, http.MethodPatch, location, patch, pngData[half:])
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("wrong status code for last chunk. wanted=204, got=%d", res.StatusCode)
+	}
+	if res.Header.Get("Upload-Offset") != strconv.Itoa(len(pngData)) {
+		t.Errorf("wrong final offset. wanted=%d, got=%s", len(pngData), res.Header.Get("Upload-Offset"))
+	}
+
+	if completed == nil {
+		t.Fatal("OnComplete was not called")
+	}
+	if completed.OrigFileName != "photo.png" || completed.ContentType != "image/png" {
+		t.Errorf("wrong completed file: %+v", completed)
+	}
+	rc, err := store.Get(context.Background(), "uploads/"+completed.NewFileName)
+	if err != nil {
+		t.Fatalf("expected completed file in storage: %s", err)
+	}
+	saved, _ := io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(saved, pngData) {
+		t.Error("saved file does not match what was uploaded")
+	}
+
+	// the upload can still be asked about, and terminated
+	res, _ = tusRequest(t, http.MethodHead, location, nil, nil)
+	if res.StatusCode != http.StatusOK || res.Header.Get("Upload-Offset") != strconv.Itoa(len(pngData)) {
+		t.Errorf("wrong response for completed upload. status=%d, offset=%s", res.StatusCode, res.Header.Get("Upload-Offset"))
+	}
+	res, _ = tusRequest(t, http.MethodDelete, location, nil, nil)
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("wrong status code for termination. wanted=204, got=%d", res.StatusCode)
+	}
+	res, _ = tusRequest(t, http.MethodHead, location, nil, nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("wrong status code after termination. wanted=404, got=%d", res.StatusCode)
+	}
+}
+
+var tusRejectTests = []struct {
+	name           string
+	method         string
+	path           string
+	headers        map[string]string
+	body           []byte
+	expectedStatus int
+}{
+	{name: "wrong version", method: http.MethodPost, path: "/files/", headers: map[string]string{"Tus-Resumable": "0.2.2", "Upload-Length": "10"}, expectedStatus: http.StatusPreconditionFailed},
+	{name: "missing length", method: http.MethodPost, path: "/files/", expectedStatus: http.StatusBadRequest},
+	{name: "too large", method: http.MethodPost, path: "/files/", headers: map[string]string{"Upload-Length": "2000"}, expectedStatus: http.StatusRequestEntityTooLarge},
+	{name: "bad metadata", method: http.MethodPost, path: "/files/", headers: map[string]string{"Upload-Length": "10", "Upload-Metadata": "filename !!"}, expectedStatus: http.StatusBadRequest},
+	{name: "wrong type", method: http.MethodPost, path: "/files/", headers: map[string]string{"Upload-Length": "12", "Content-Type": "application/offset+octet-stream"}, body: []byte("not an image"), expectedStatus: http.StatusUnsupportedMediaType},
+	{name: "unknown upload", method: http.MethodHead, path: "/files/00112233445566778899aabbccddeeff", expectedStatus: http.StatusNotFound},
+	{name: "invalid id", method: http.MethodHead, path: "/files/..%2f..%2fetc", expectedStatus: http.StatusNotFound},
+}
+
+func TestTusHandler_Reject(t *testing.T) {
+	var testTools Tools
+	testTools.Storage = &MemoryStorage{}
+	testTools.UploadedFile.AllowedFileTypes = []string{"image/png"}
+	testTools.UploadedFile.MaxFileSize = 1000
+
+	partialDir := t.TempDir()
+	srv := newTusServer(t, &TusHandler{Tools: &testTools, BasePath: "/files/", PartialDir: partialDir})
+
+	for _, e := range tusRejectTests {
+		res, _ := tusRequest(t, e.method, srv.URL+e.path, e.headers, e.body)
+		if res.StatusCode != e.expectedStatus {
+			t.Errorf("%s: wrong status code. wanted=%d, got=%d", e.name, e.expectedStatus, res.StatusCode)
+		}
+	}
+
+	// the upload refused for its type must be gone
+	h := &TusHandler{PartialDir: partialDir}
+	if n, _ := h.RemoveExpired(); n != 0 {
+		t.Errorf("expected no uploads to be left, removed %d", n)
+	}
+}
+
+func TestTusHandler_Expiration(t *testing.T) {
+	now := time.Now()
+	h := &TusHandler{
+		Tools:      &Tools{Storage: &MemoryStorage{}},
+		BasePath:   "/files/",
+		PartialDir: t.TempDir(),
+		Expiration: time.Hour,
+		now:        func() time.Time { return now },
+	}
+	srv := newTusServer(t, h)
+
+	var locations []string
+	for i := 0; i < 2; i++ {
+		res, _ := tusRequest(t, http.MethodPost, srv.URL+"/files/", map[string]string{"Upload-Length": "10"}, nil)
+		if res.Header.Get("Upload-Expires") == "" {
+			t.Error("expected Upload-Expires header")
+		}
+		locations = append(locations, srv.URL+res.Header.Get("Location"))
+	}
+
+	now = now.Add(2 * time.Hour)
+
+	res, _ := tusRequest(t, http.MethodHead, locations[0], nil, nil)
+	if res.StatusCode != http.StatusGone {
+		t.Errorf("wrong status code for expired upload. wanted=410, got=%d", res.StatusCode)
+	}
+
+	removed, err := h.RemoveExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("wrong number of expired uploads removed. wanted=1, got=%d", removed)
+	}
+}
+
+var tusCompleteErrorTests = []struct {
+	name           string
+	scanErr        error
+	expectedStatus int
+	kept           bool
+}{
+	{name: "cancelled", scanErr: context.Canceled, expectedStatus: http.StatusInternalServerError, kept: true},
+	{name: "scanner down", scanErr: errors.New("connection refused"), expectedStatus: http.StatusInternalServerError, kept: true},
+	{name: "infected", scanErr: &InfectedFileError{Threat: "Eicar-Test-Signature"}, expectedStatus: http.StatusUnprocessableEntity},
+}
+
+func TestTusHandler_CompleteError(t *testing.T) {
+	pngData := testPNG(t)
+
+	for _, e := range tusCompleteErrorTests {
+		var store MemoryStorage
+		scanErr := e.scanErr
+		testTools := Tools{Storage: &store}
+		testTools.Scanner = scanFunc(func(ctx context.Context, fileName string, r io.Reader) error { return scanErr })
+		srv := newTusServer(t, &TusHandler{Tools: &testTools, BasePath: "/files/", PartialDir: t.TempDir()})
+
+		res, _ := tusRequest(t, http.MethodPost, srv.URL+"/files/", map[string]string{
+			"Upload-Length": strconv.Itoa(len(pngData)),
+			"Content-Type":  "application/offset+octet-stream",
+		}, pngData)
+		if res.StatusCode != e.expectedStatus {
+			t.Errorf("%s: wrong status code. wanted=%d, got=%d", e.name, e.expectedStatus, res.StatusCode)
+		}
+		location := srv.URL + res.Header.Get("Location")
+
+		res, _ = tusRequest(t, http.MethodHead, location, nil, nil)
+		if !e.kept {
+			if res.StatusCode != http.StatusNotFound {
+				t.Errorf("%s: wrong status code for rejected upload. wanted=404, got=%d", e.name, res.StatusCode)
+			}
+			continue
+		}
+		if res.StatusCode != http.StatusOK || res.Header.Get("Upload-Offset") != strconv.Itoa(len(pngData)) {
+			t.Errorf("%s: expected the received bytes to be kept. status=%d, offset=%s", e.name, res.StatusCode, res.Header.Get("Upload-Offset"))
+			continue
+		}
+
+		// once the scanner is back, sending the last PATCH again completes the upload
+		scanErr = nil
+		patch := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": strconv.Itoa(len(pngData))}
+		res, _ = tusRequest(t, http.MethodPatch, location, patch, nil)
+		if res.StatusCode != http.StatusNoContent {
+			t.Errorf("%s: wrong status code for retry. wanted=204, got=%d", e.name, res.StatusCode)
+		}
+		if files, _ := store.List(context.Background(), ""); len(files) != 1 {
+			t.Errorf("%s: wrong number of files stored. wanted=1, got=%d", e.name, len(files))
+		}
+	}
+}
+
+func TestTusHandler_ExpireCompleted(t *testing.T) {
+	now := time.Now()
+	h := &TusHandler{
+		Tools:      &Tools{Storage: &MemoryStorage{}},
+		BasePath:   "/files/",
+		PartialDir: t.TempDir(),
+		Expiration: time.Hour,
+		now:        func() time.Time { return now },
+	}
+	srv := newTusServer(t, h)
+
+	res, _ := tusRequest(t, http.MethodPost, srv.URL+"/files/", map[string]string{"Upload-Length": "5"}, nil)
+	location := srv.URL + res.Header.Get("Location")
+	patch := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+	if res, _ = tusRequest(t, http.MethodPatch, location, patch, []byte("hello")); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("wrong status code for upload. wanted=204, got=%d", res.StatusCode)
+	}
+
+	locks := 0
+	h.locks.Range(func(key, value any) bool { locks++; return true })
+	if locks != 0 {
+		t.Errorf("wrong number of locks left. wanted=0, got=%d", locks)
+	}
+
+	// the state of the completed upload is kept until it expires
+	if removed, _ := h.RemoveExpired(); removed != 0 {
+		t.Errorf("wrong number of uploads removed before expiration. wanted=0, got=%d", removed)
+	}
+	now = now.Add(2 * time.Hour)
+	if removed, _ := h.RemoveExpired(); removed != 1 {
+		t.Errorf("wrong number of uploads removed. wanted=1, got=%d", removed)
+	}
+	if entries, _ := os.ReadDir(h.PartialDir); len(entries) != 0 {
+		t.Errorf("wrong number of files left. wanted=0, got=%d", len(entries))
+	}
+}
+
+func TestTusHandler_CompleteConcurrently(t *testing.T) {
+	testTools := Tools{Storage: &MemoryStorage{}}
+	h := &TusHandler{Tools: &testTools, BasePath: "/files/", PartialDir: t.TempDir()}
+	srv := newTusServer(t, h)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, _ := tusRequest(t, http.MethodPost, srv.URL+"/files/", map[string]string{
+				"Upload-Length": "5",
+				"Content-Type":  "application/offset+octet-stream",
+			}, []byte("hello"))
+			if res.StatusCode != http.StatusCreated {
+				t.Errorf("wrong status code. wanted=201, got=%d", res.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the default size limit of the handler is not written into the shared Tools
+	if testTools.UploadedFile.MaxFileSize != 0 {
+		t.Errorf("wrong MaxFileSize. wanted=0, got=%d", testTools.UploadedFile.MaxFileSize)
+	}
+}
+
+func TestTusHandler_UnknownUploadLocks(t *testing.T) {
+	h := &TusHandler{Tools: &Tools{Storage: &MemoryStorage{}}, BasePath: "/files/", PartialDir: t.TempDir()}
+	srv := newTusServer(t, h)
+
+	patch := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+	for i := 0; i < 20; i++ {
+		id, err := randomID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _ := tusRequest(t, http.MethodPatch, srv.URL+"/files/"+id, patch, []byte("hello"))
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("wrong status code. wanted=404, got=%d", res.StatusCode)
+		}
+	}
+
+	locks := 0
+	h.locks.Range(func(key, value any) bool { locks++; return true })
+	if locks != 0 {
+		t.Errorf("wrong number of locks left. wanted=0, got=%d", locks)
+	}
+}
+
+func TestTusHandler_TerminateWhileWriting(t *testing.T) {
+	h := &TusHandler{Tools: &Tools{Storage: &MemoryStorage{}}, BasePath: "/files/", PartialDir: t.TempDir()}
+	srv := newTusServer(t, h)
+
+	res, _ := tusRequest(t, http.MethodPost, srv.URL+"/files/", map[string]string{"Upload-Length": "10"}, nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("wrong status code for creation. wanted=201, got=%d", res.StatusCode)
+	}
+	location := res.Header.Get("Location")
+
+	// the handler is called directly, so once a write to the pipe returns, it holds the lock
+	pr, pw := io.Pipe()
+	req := httptest.NewRequest(http.MethodPatch, location, pr)
+	req.Header.Set("Tus-Resumable", TusVersion)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(rec, req)
+	}()
+	if _, err := pw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	res, _ = tusRequest(t, http.MethodDelete, srv.URL+location, nil, nil)
+	if res.StatusCode != http.StatusLocked {
+		t.Errorf("wrong status code for termination. wanted=423, got=%d", res.StatusCode)
+	}
+
+	pw.Close()
+	<-done
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("wrong status code for the write. wanted=204, got=%d", rec.Code)
+	}
+	res, _ = tusRequest(t, http.MethodHead, srv.URL+location, nil, nil)
+	if res.StatusCode != http.StatusOK || res.Header.Get("Upload-Offset") != "5" {
+		t.Errorf("wrong upload state. status=%d, offset=%s", res.StatusCode, res.Header.Get("Upload-Offset"))
+	}
+
+	res, _ = tusRequest(t, http.MethodDelete, srv.URL+location, nil, nil)
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("wrong status code for termination. wanted=204, got=%d", res.StatusCode)
+	}
+}